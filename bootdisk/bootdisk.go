@@ -0,0 +1,272 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package bootdisk finds out, without any help from the host, what a disk
+// installed by coreos-install would boot: it reads the disk's GPT, picks the
+// /usr partition that CoreOS' grub would, and fetches that partition's kernel
+// from the EFI system partition (FAT) and the OEM's settings from the OEM
+// partition (ext4).
+//
+// CoreOS' kernels carry their initramfs built in, so there's no separate
+// initrd to fetch.
+package bootdisk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// the partition types and UUIDs that coreos-install lays down
+const (
+	efiSystemType = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	usrType       = "5dfbf5f4-2848-4bac-aa5e-0d9a20b745a6"
+	usrA          = "7130c94a-213a-4e5a-8e26-6cce9662f132"
+	usrB          = "e03dd35c-7c2d-4a47-b3fe-27f15780a57c"
+)
+
+// FS is a read-only filesystem, with just enough to fetch files from it
+type FS interface {
+	ReadFile(path string) ([]byte, error)
+}
+
+// OpenFS detects the filesystem (ext2/3/4 or FAT) in the given partition,
+// and opens it
+func OpenFS(r io.ReaderAt) (FS, error) {
+	if e, err := openExt(r); err == nil {
+		return e, nil
+	}
+	if f, err := openFAT(r); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("no ext2/3/4 or FAT filesystem found")
+}
+
+// Boot is what a CoreOS disk is set to boot
+type Boot struct {
+	// Slot names the /usr partition that gets booted (USR-A or USR-B)
+	Slot    string
+	Kernel  []byte
+	Cmdline []string
+	// Version and Channel are those of the /usr partition that gets booted,
+	// if they could be found out
+	Version, Channel string
+
+	gpt *GPT
+	usr Partition
+}
+
+// gptprio holds the attributes by which CoreOS' grub picks the /usr
+// partition to boot, and so by which updates get tried and rolled back
+type gptprio struct {
+	priority, tries uint64
+	successful      bool
+}
+
+func gptprioOf(p Partition) gptprio {
+	return gptprio{
+		priority:   p.Attributes >> 48 & 0xf,
+		tries:      p.Attributes >> 52 & 0xf,
+		successful: p.Attributes>>56&1 == 1,
+	}
+}
+
+// CoreOS finds out what the given CoreOS disk boots, exactly as its grub
+// would: the highest priority /usr partition that either booted successfully
+// before or still has tries left, with its kernel and command line
+func CoreOS(disk io.ReaderAt) (b *Boot, err error) {
+	var (
+		esp, oem, root, usr FS
+		found               bool
+		best                gptprio
+		kernel              string
+		g                   *GPT
+		p                   Partition
+	)
+	if g, err = ReadGPT(disk); err != nil {
+		return
+	}
+	b = &Boot{gpt: g}
+	for _, p = range g.Partitions {
+		prio := gptprioOf(p)
+		if p.Type != usrType || prio.priority == 0 ||
+			(!prio.successful && prio.tries == 0) {
+			continue
+		}
+		if !found || prio.priority > best.priority {
+			b.usr, best, found = p, prio, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no bootable /usr partition found")
+	}
+	switch b.usr.UUID {
+	case usrA:
+		b.Slot, kernel = "USR-A", "/coreos/vmlinuz-a"
+	case usrB:
+		b.Slot, kernel = "USR-B", "/coreos/vmlinuz-b"
+	default:
+		return nil, fmt.Errorf("%s isn't one of CoreOS' /usr partitions",
+			b.usr.UUID)
+	}
+
+	found = false
+	for _, p = range g.Partitions {
+		if p.Type == efiSystemType {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no EFI system partition found")
+	}
+	if esp, err = OpenFS(p.Section(disk)); err != nil {
+		return nil, fmt.Errorf("EFI system partition: %v", err)
+	}
+	if b.Kernel, err = esp.ReadFile(kernel); err != nil {
+		return nil, fmt.Errorf("EFI system partition: %v", err)
+	}
+
+	b.Cmdline = []string{"root=LABEL=ROOT", "rootflags=rw",
+		"mount.usrflags=ro", "consoleblank=0"}
+	var oemID string
+	var appended []string
+	if p, found = g.Find("OEM"); found {
+		if oem, err = OpenFS(p.Section(disk)); err != nil {
+			return nil, fmt.Errorf("OEM partition: %v", err)
+		}
+		if cfg, e := oem.ReadFile("/grub.cfg"); e == nil {
+			oemID, appended = oemGrubSettings(cfg)
+		}
+	}
+	if oemID != "" {
+		b.Cmdline = append(b.Cmdline, "coreos.oem.id="+oemID)
+	}
+	if _, e := esp.ReadFile("/coreos/first_boot"); e == nil {
+		b.Cmdline = append(b.Cmdline, "coreos.first_boot=detected")
+	}
+	if hash := verityHash(b.Kernel); hash != "" {
+		b.Cmdline = append(b.Cmdline, "mount.usr=/dev/mapper/usr",
+			"verity.usr=PARTUUID="+b.usr.UUID, "verity.usrhash="+hash)
+	} else {
+		b.Cmdline = append(b.Cmdline, "mount.usr=PARTUUID="+b.usr.UUID)
+	}
+	b.Cmdline = append(b.Cmdline, appended...)
+
+	// best effort, as neither is needed to boot
+	if usr, err = OpenFS(b.usr.Section(disk)); err == nil {
+		if release, e := usr.ReadFile("/share/coreos/release"); e == nil {
+			b.Version = keyValue(release, "COREOS_RELEASE_VERSION")
+		}
+		if conf, e := usr.ReadFile("/share/coreos/update.conf"); e == nil {
+			b.Channel = keyValue(conf, "GROUP")
+		}
+	}
+	if p, found = g.Find("ROOT"); found {
+		if root, err = OpenFS(p.Section(disk)); err == nil {
+			if conf, e := root.ReadFile("/etc/coreos/update.conf"); e == nil {
+				if group := keyValue(conf, "GROUP"); group != "" {
+					b.Channel = group
+				}
+			}
+		}
+	}
+	return b, nil
+}
+
+// Commit uses up one of the tries of the /usr partition being booted, if
+// it never booted successfully before (as it happens once updated), just as
+// grub does. Once out of tries, the other /usr partition gets booted instead
+func (b *Boot) Commit(disk ReadWriterAt) (err error) {
+	prio := gptprioOf(b.usr)
+	if prio.successful || prio.tries == 0 {
+		return
+	}
+	attr := b.usr.Attributes&^(0xf<<52) | (prio.tries-1)<<52
+	if err = b.gpt.SetAttributes(disk, b.usr.Number, attr); err != nil {
+		return
+	}
+	b.usr.Attributes = attr
+	return
+}
+
+// Open is CoreOS, for a disk image at the given path
+func Open(path string) (b *Boot, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	if b, err = CoreOS(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+// verityHash returns the dm-verity root hash of /usr that CoreOS' build
+// stashes within its kernel's image, at offset 64, if there's one
+func verityHash(kernel []byte) string {
+	if len(kernel) < 96 {
+		return ""
+	}
+	hash := kernel[64:96]
+	// unsigned images have there the usual MS-DOS stub's message
+	printable := true
+	for _, c := range hash {
+		printable = printable && c < unicode.MaxASCII &&
+			(unicode.IsPrint(rune(c)) || unicode.IsSpace(rune(c)))
+	}
+	if printable || isZero(hash) {
+		return ""
+	}
+	return hex.EncodeToString(hash)
+}
+
+// oemGrubSettings reads the OEM's id and extra kernel arguments out of the
+// grub.cfg snippet that the OEM partition carries
+func oemGrubSettings(cfg []byte) (id string, args []string) {
+	s := bufio.NewScanner(bytes.NewReader(cfg))
+	for s.Scan() {
+		f := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(f) != 2 || !strings.HasPrefix(f[0], "set ") {
+			continue
+		}
+		v := strings.Trim(f[1], `"'`)
+		switch strings.TrimSpace(strings.TrimPrefix(f[0], "set ")) {
+		case "oem_id":
+			id = v
+		case "linux_append":
+			args = strings.Fields(v)
+		}
+	}
+	return
+}
+
+// keyValue returns the value of the given key in a KEY=VALUE file
+func keyValue(data []byte, key string) string {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		f := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(f) == 2 && f[0] == key {
+			return strings.Trim(f[1], `"'`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package bootdisk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	extMagic        = 0xef53
+	extRootInode    = 2
+	ext64bit        = 0x80
+	extExtentsFlag  = 0x80000
+	extInlineFlag   = 0x10000000
+	extExtentMagic  = 0xf30a
+	extMaxFileSize  = 1 << 30
+	extModeTypeMask = 0xf000
+	extModeDir      = 0x4000
+	extModeRegular  = 0x8000
+)
+
+// extfs is a read-only ext2, ext3 or ext4 filesystem
+type extfs struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodesPerGroup uint32
+	inodeSize      int64
+	descSize       int64
+	descOffset     int64
+	is64bit        bool
+}
+
+// extInode holds just what's needed, of an inode, to read its contents
+type extInode struct {
+	mode   uint16
+	size   int64
+	flags  uint32
+	blocks []byte
+}
+
+func openExt(r io.ReaderAt) (e *extfs, err error) {
+	var sb = make([]byte, 1024)
+	if _, err = r.ReadAt(sb, 1024); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint16(sb[56:]) != extMagic {
+		return nil, fmt.Errorf("not an ext2/3/4 filesystem")
+	}
+	logBlockSize := binary.LittleEndian.Uint32(sb[24:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("bogus ext2/3/4 block size")
+	}
+	e = &extfs{
+		r:              r,
+		blockSize:      1024 << logBlockSize,
+		inodesPerGroup: binary.LittleEndian.Uint32(sb[40:]),
+		inodeSize:      128,
+		descSize:       32,
+		is64bit:        binary.LittleEndian.Uint32(sb[96:])&ext64bit != 0,
+	}
+	if binary.LittleEndian.Uint32(sb[76:]) > 0 {
+		e.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	if e.is64bit {
+		if ds := int64(binary.LittleEndian.Uint16(sb[254:])); ds > 32 {
+			e.descSize = ds
+		}
+	}
+	if e.inodesPerGroup == 0 || e.inodeSize < 128 {
+		return nil, fmt.Errorf("bogus ext2/3/4 filesystem")
+	}
+	// group descriptors start right after the superblock's block
+	e.descOffset = (int64(binary.LittleEndian.Uint32(sb[20:])) + 1) *
+		e.blockSize
+	return
+}
+
+func (e *extfs) inode(n uint32) (i extInode, err error) {
+	var (
+		group = int64((n - 1) / e.inodesPerGroup)
+		index = int64((n - 1) % e.inodesPerGroup)
+		desc  = make([]byte, e.descSize)
+		raw   = make([]byte, e.inodeSize)
+	)
+	if n == 0 {
+		return i, fmt.Errorf("bogus inode number")
+	}
+	if _, err = e.r.ReadAt(desc, e.descOffset+group*e.descSize); err != nil {
+		return
+	}
+	table := int64(binary.LittleEndian.Uint32(desc[8:]))
+	if e.is64bit && e.descSize >= 64 {
+		table |= int64(binary.LittleEndian.Uint32(desc[40:])) << 32
+	}
+	if _, err = e.r.ReadAt(raw,
+		table*e.blockSize+index*e.inodeSize); err != nil {
+		return
+	}
+	i = extInode{
+		mode: binary.LittleEndian.Uint16(raw[0:]),
+		size: int64(binary.LittleEndian.Uint32(raw[4:])) |
+			int64(binary.LittleEndian.Uint32(raw[108:]))<<32,
+		flags:  binary.LittleEndian.Uint32(raw[32:]),
+		blocks: raw[40:100],
+	}
+	return
+}
+
+func (e *extfs) block(n int64) (b []byte, err error) {
+	b = make([]byte, e.blockSize)
+	_, err = e.r.ReadAt(b, n*e.blockSize)
+	return
+}
+
+// contents reads all of an inode's data, leaving holes as zeroes
+func (e *extfs) contents(i extInode) (data []byte, err error) {
+	if i.size > extMaxFileSize {
+		return nil, fmt.Errorf("file too big (%d bytes)", i.size)
+	}
+	if i.flags&extInlineFlag != 0 {
+		return nil, fmt.Errorf("inline data isn't supported")
+	}
+	data = make([]byte, i.size)
+	put := func(logical, physical int64) (err error) {
+		var b []byte
+		off := logical * e.blockSize
+		if off >= i.size || physical == 0 {
+			return
+		}
+		if b, err = e.block(physical); err != nil {
+			return
+		}
+		copy(data[off:], b)
+		return
+	}
+	if i.flags&extExtentsFlag != 0 {
+		err = e.walkExtents(i.blocks, put, 0)
+	} else {
+		err = e.walkBlockMap(i.blocks, put)
+	}
+	return
+}
+
+// walkExtents goes through an extent tree (node), calling put for each
+// mapped block
+func (e *extfs) walkExtents(node []byte,
+	put func(logical, physical int64) error, level int) (err error) {
+	if binary.LittleEndian.Uint16(node[0:]) != extExtentMagic || level > 5 {
+		return fmt.Errorf("broken extent tree")
+	}
+	var (
+		entries = int(binary.LittleEndian.Uint16(node[2:]))
+		depth   = binary.LittleEndian.Uint16(node[6:])
+	)
+	if 12+entries*12 > len(node) {
+		return fmt.Errorf("broken extent tree")
+	}
+	for n := 0; n < entries; n++ {
+		x := node[12+n*12:]
+		logical := int64(binary.LittleEndian.Uint32(x[0:]))
+		if depth > 0 {
+			var child []byte
+			leaf := int64(binary.LittleEndian.Uint32(x[4:])) |
+				int64(binary.LittleEndian.Uint16(x[8:]))<<32
+			if child, err = e.block(leaf); err != nil {
+				return
+			}
+			if err = e.walkExtents(child, put, level+1); err != nil {
+				return
+			}
+			continue
+		}
+		length := int64(binary.LittleEndian.Uint16(x[4:]))
+		if length > 32768 {
+			// uninitialized extents read as zeroes
+			continue
+		}
+		start := int64(binary.LittleEndian.Uint32(x[8:])) |
+			int64(binary.LittleEndian.Uint16(x[6:]))<<32
+		for b := int64(0); b < length; b++ {
+			if err = put(logical+b, start+b); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// walkBlockMap goes through ext2/3's direct and (single, double and triple)
+// indirect block pointers, calling put for each mapped block
+func (e *extfs) walkBlockMap(pointers []byte,
+	put func(logical, physical int64) error) (err error) {
+	var (
+		logical  int64
+		perBlock = e.blockSize / 4
+		walk     func(block int64, depth int) error
+	)
+	walk = func(block int64, depth int) (err error) {
+		if depth == 0 {
+			err = put(logical, block)
+			logical++
+			return
+		}
+		if block == 0 {
+			for d, n := 0, int64(1); d < depth; d++ {
+				n *= perBlock
+				if d == depth-1 {
+					logical += n
+				}
+			}
+			return
+		}
+		var b []byte
+		if b, err = e.block(block); err != nil {
+			return
+		}
+		for n := int64(0); n < perBlock; n++ {
+			if err = walk(int64(binary.LittleEndian.Uint32(b[n*4:])),
+				depth-1); err != nil {
+				return
+			}
+		}
+		return
+	}
+	for n := 0; n < 15; n++ {
+		depth := 0
+		if n >= 12 {
+			depth = n - 11
+		}
+		if err = walk(int64(binary.LittleEndian.Uint32(pointers[n*4:])),
+			depth); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// lookup finds the inode at the given path
+func (e *extfs) lookup(path string) (i extInode, err error) {
+	if i, err = e.inode(extRootInode); err != nil {
+		return
+	}
+	for _, c := range strings.Split(strings.Trim(path, "/"), "/") {
+		if c == "" {
+			continue
+		}
+		var data []byte
+		if i.mode&extModeTypeMask != extModeDir {
+			return i, &os.PathError{Op: "open", Path: path,
+				Err: fmt.Errorf("not a directory")}
+		}
+		if data, err = e.contents(i); err != nil {
+			return
+		}
+		found := uint32(0)
+		// a linear scan finds every entry of hashed (htree) directories
+		// too, as their index blocks look like empty entries
+		for off := 0; off+8 <= len(data); {
+			inode := binary.LittleEndian.Uint32(data[off:])
+			recLen := int(binary.LittleEndian.Uint16(data[off+4:]))
+			nameLen := int(data[off+6])
+			if recLen < 8 || off+8+nameLen > len(data) {
+				break
+			}
+			if inode != 0 && string(data[off+8:off+8+nameLen]) == c {
+				found = inode
+				break
+			}
+			off += recLen
+		}
+		if found == 0 {
+			return i, &os.PathError{Op: "open", Path: path,
+				Err: os.ErrNotExist}
+		}
+		if i, err = e.inode(found); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (e *extfs) ReadFile(path string) (data []byte, err error) {
+	var i extInode
+	if i, err = e.lookup(path); err != nil {
+		return
+	}
+	if i.mode&extModeTypeMask != extModeRegular {
+		return nil, &os.PathError{Op: "read", Path: path,
+			Err: fmt.Errorf("not a regular file")}
+	}
+	return e.contents(i)
+}
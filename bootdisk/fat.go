@@ -0,0 +1,301 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package bootdisk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// fat is a read-only FAT12, FAT16 or FAT32 filesystem
+type fat struct {
+	r    io.ReaderAt
+	bits int
+	// table is the (first) file allocation table
+	table       []byte
+	clusterSize int64
+	clusters    uint32
+	// the root directory is either a fixed region (FAT12/16), or a cluster
+	// chain as any other directory (FAT32)
+	rootOffset  int64
+	rootEntries uint32
+	rootCluster uint32
+	dataOffset  int64
+}
+
+// fatEntry is a directory entry
+type fatEntry struct {
+	name    string
+	short   string
+	cluster uint32
+	size    uint32
+	dir     bool
+}
+
+func openFAT(r io.ReaderAt) (f *fat, err error) {
+	var bpb = make([]byte, sectorSize)
+	if _, err = r.ReadAt(bpb, 0); err != nil {
+		return
+	}
+	if bpb[510] != 0x55 || bpb[511] != 0xaa {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+	var (
+		bytesPerSector    = uint32(binary.LittleEndian.Uint16(bpb[11:]))
+		sectorsPerCluster = uint32(bpb[13])
+		reserved          = uint32(binary.LittleEndian.Uint16(bpb[14:]))
+		fats              = uint32(bpb[16])
+		rootEntries       = uint32(binary.LittleEndian.Uint16(bpb[17:]))
+		sectors           = uint32(binary.LittleEndian.Uint16(bpb[19:]))
+		fatSize           = uint32(binary.LittleEndian.Uint16(bpb[22:]))
+	)
+	switch bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+	if sectorsPerCluster == 0 ||
+		sectorsPerCluster&(sectorsPerCluster-1) != 0 || fats == 0 {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+	if sectors == 0 {
+		sectors = binary.LittleEndian.Uint32(bpb[32:])
+	}
+	if fatSize == 0 {
+		fatSize = binary.LittleEndian.Uint32(bpb[36:])
+	}
+	rootSectors := (rootEntries*32 + bytesPerSector - 1) / bytesPerSector
+	meta := reserved + fats*fatSize + rootSectors
+	if sectors <= meta {
+		return nil, fmt.Errorf("bogus FAT filesystem")
+	}
+	f = &fat{
+		r:           r,
+		clusterSize: int64(sectorsPerCluster * bytesPerSector),
+		clusters:    (sectors - meta) / sectorsPerCluster,
+		rootOffset:  int64(reserved+fats*fatSize) * int64(bytesPerSector),
+		rootEntries: rootEntries,
+		dataOffset:  int64(meta) * int64(bytesPerSector),
+	}
+	switch {
+	case f.clusters < 4085:
+		f.bits = 12
+	case f.clusters < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+		f.rootCluster = binary.LittleEndian.Uint32(bpb[44:])
+	}
+	f.table = make([]byte, int64(fatSize)*int64(bytesPerSector))
+	if _, err = r.ReadAt(f.table,
+		int64(reserved)*int64(bytesPerSector)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// next returns the cluster following the given one in its chain, and
+// whether the chain goes on at all
+func (f *fat) next(cluster uint32) (next uint32, more bool, err error) {
+	switch f.bits {
+	case 12:
+		off := cluster + cluster/2
+		if int(off)+2 > len(f.table) {
+			break
+		}
+		next = uint32(binary.LittleEndian.Uint16(f.table[off:]))
+		if cluster&1 == 1 {
+			next >>= 4
+		}
+		next &= 0xfff
+		return next, next < 0xff8, f.checkCluster(next, 0xff8)
+	case 16:
+		if int(cluster)*2+2 > len(f.table) {
+			break
+		}
+		next = uint32(binary.LittleEndian.Uint16(f.table[cluster*2:]))
+		return next, next < 0xfff8, f.checkCluster(next, 0xfff8)
+	default:
+		if int(cluster)*4+4 > len(f.table) {
+			break
+		}
+		next = binary.LittleEndian.Uint32(f.table[cluster*4:]) & 0x0fffffff
+		return next, next < 0x0ffffff8, f.checkCluster(next, 0x0ffffff8)
+	}
+	return 0, false, fmt.Errorf("cluster %d out of the FAT", cluster)
+}
+
+func (f *fat) checkCluster(c, eoc uint32) error {
+	if c >= eoc {
+		return nil
+	}
+	if c < 2 || c >= f.clusters+2 {
+		return fmt.Errorf("broken FAT cluster chain (cluster %d)", c)
+	}
+	return nil
+}
+
+// readChain reads the cluster chain starting at the given cluster, up to
+// size bytes or, if size is negative, up to its end
+func (f *fat) readChain(cluster uint32, size int64) (data []byte, err error) {
+	var (
+		more = cluster >= 2
+		buf  = make([]byte, f.clusterSize)
+	)
+	for n := uint32(0); more && (size < 0 || int64(len(data)) < size); n++ {
+		if n > f.clusters {
+			return nil, fmt.Errorf("looping FAT cluster chain")
+		}
+		if err = f.checkCluster(cluster, 0xffffffff); err != nil {
+			return
+		}
+		if _, err = f.r.ReadAt(buf,
+			f.dataOffset+int64(cluster-2)*f.clusterSize); err != nil {
+			return
+		}
+		data = append(data, buf...)
+		if cluster, more, err = f.next(cluster); err != nil {
+			return
+		}
+	}
+	if size >= 0 {
+		if int64(len(data)) < size {
+			return nil, fmt.Errorf("FAT cluster chain shorter than its file")
+		}
+		data = data[:size]
+	}
+	return
+}
+
+// entries parses the given raw directory
+func (f *fat) entries(raw []byte) (entries []fatEntry) {
+	var long = map[int][]uint16{}
+	for i := 0; i+32 <= len(raw); i += 32 {
+		e := raw[i : i+32]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] == 0xe5 {
+			long = map[int][]uint16{}
+			continue
+		}
+		// long file names come as a run of pseudo entries, in reverse
+		// order, ahead of their file's own
+		if e[11] == 0x0f {
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for j := r[0]; j < r[1]; j += 2 {
+					part = append(part, binary.LittleEndian.Uint16(e[j:]))
+				}
+			}
+			long[int(e[0]&0x3f)] = part
+			continue
+		}
+		if e[11]&0x08 != 0 {
+			// volume label
+			long = map[int][]uint16{}
+			continue
+		}
+		entry := fatEntry{
+			short: strings.TrimRight(string(e[0:8]), " "),
+			cluster: uint32(binary.LittleEndian.Uint16(e[20:]))<<16 |
+				uint32(binary.LittleEndian.Uint16(e[26:])),
+			size: binary.LittleEndian.Uint32(e[28:]),
+			dir:  e[11]&0x10 != 0,
+		}
+		if ext := strings.TrimRight(string(e[8:11]), " "); ext != "" {
+			entry.short += "." + ext
+		}
+		if len(long) > 0 {
+			var name []uint16
+		chars:
+			for n := 1; n <= len(long); n++ {
+				for _, c := range long[n] {
+					if c == 0 || c == 0xffff {
+						break chars
+					}
+					name = append(name, c)
+				}
+			}
+			entry.name = string(utf16.Decode(name))
+			long = map[int][]uint16{}
+		}
+		if entry.name == "" {
+			entry.name = entry.short
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// lookup finds the entry at the given path, which FAT compares without
+// regard to case
+func (f *fat) lookup(path string) (entry fatEntry, err error) {
+	var raw []byte
+	if f.bits == 32 {
+		if raw, err = f.readChain(f.rootCluster, -1); err != nil {
+			return
+		}
+	} else {
+		raw = make([]byte, f.rootEntries*32)
+		if _, err = f.r.ReadAt(raw, f.rootOffset); err != nil {
+			return
+		}
+	}
+	entry.dir = true
+	for _, c := range strings.Split(strings.Trim(path, "/"), "/") {
+		if c == "" {
+			continue
+		}
+		if !entry.dir {
+			return entry, &os.PathError{Op: "open", Path: path,
+				Err: fmt.Errorf("not a directory")}
+		}
+		if entry.cluster != 0 {
+			if raw, err = f.readChain(entry.cluster, -1); err != nil {
+				return
+			}
+		}
+		found := false
+		for _, e := range f.entries(raw) {
+			if strings.EqualFold(e.name, c) || strings.EqualFold(e.short, c) {
+				entry, found = e, true
+				break
+			}
+		}
+		if !found {
+			return entry, &os.PathError{Op: "open", Path: path,
+				Err: os.ErrNotExist}
+		}
+	}
+	return
+}
+
+func (f *fat) ReadFile(path string) (data []byte, err error) {
+	var entry fatEntry
+	if entry, err = f.lookup(path); err != nil {
+		return
+	}
+	if entry.dir {
+		return nil, &os.PathError{Op: "read", Path: path,
+			Err: fmt.Errorf("is a directory")}
+	}
+	return f.readChain(entry.cluster, int64(entry.size))
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package bootdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const sectorSize = 512
+
+// Partition is an entry of a GPT
+type Partition struct {
+	// Number is the partition's (1 based) index in the table
+	Number int
+	// Type and UUID are GUIDs, in their canonical (lowercase) form
+	Type, UUID string
+	Name       string
+	// First and Last are the partition's first and last LBAs, inclusive
+	First, Last int64
+	Attributes  uint64
+}
+
+// Offset returns where the partition starts, in bytes
+func (p Partition) Offset() int64 { return p.First * sectorSize }
+
+// Size returns the partition's size, in bytes
+func (p Partition) Size() int64 { return (p.Last - p.First + 1) * sectorSize }
+
+// Section returns a reader limited to the partition's contents
+func (p Partition) Section(r io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(r, p.Offset(), p.Size())
+}
+
+// GPT is a disk's GUID partition table
+type GPT struct {
+	Partitions []Partition
+	// backup is the LBA of the backup header
+	backup int64
+}
+
+// ReadGPT reads the (primary) GUID partition table of the given disk
+func ReadGPT(r io.ReaderAt) (g *GPT, err error) {
+	var (
+		header, entries []byte
+		size, count     int
+	)
+	if header, entries, err = readGPTAt(r, 1); err != nil {
+		return
+	}
+	g = &GPT{backup: int64(binary.LittleEndian.Uint64(header[32:]))}
+	// as already validated by readGPTAt
+	count = int(binary.LittleEndian.Uint32(header[80:]))
+	size = int(binary.LittleEndian.Uint32(header[84:]))
+	for i := 0; i < count; i++ {
+		e := entries[i*size : (i+1)*size]
+		if isZero(e[:16]) {
+			continue
+		}
+		g.Partitions = append(g.Partitions, Partition{
+			Number:     i + 1,
+			Type:       guid(e[0:16]),
+			UUID:       guid(e[16:32]),
+			First:      int64(binary.LittleEndian.Uint64(e[32:])),
+			Last:       int64(binary.LittleEndian.Uint64(e[40:])),
+			Attributes: binary.LittleEndian.Uint64(e[48:]),
+			Name:       utf16String(e[56:128]),
+		})
+	}
+	return
+}
+
+// Find returns the partition with the given name (or label), if any
+func (g *GPT) Find(name string) (p Partition, ok bool) {
+	for _, p = range g.Partitions {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// SetAttributes rewrites the attributes of the given partition, in both the
+// primary and the backup tables, as well as their checksums
+func (g *GPT) SetAttributes(rw ReadWriterAt, number int, attr uint64) (err error) {
+	for _, lba := range []int64{1, g.backup} {
+		var header, entries []byte
+		if header, entries, err = readGPTAt(rw, lba); err != nil {
+			return
+		}
+		size := int(binary.LittleEndian.Uint32(header[84:]))
+		if number < 1 ||
+			number > int(binary.LittleEndian.Uint32(header[80:])) {
+			return fmt.Errorf("no partition number %d", number)
+		}
+		binary.LittleEndian.PutUint64(entries[(number-1)*size+48:], attr)
+		binary.LittleEndian.PutUint32(header[88:],
+			crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[16:], 0)
+		binary.LittleEndian.PutUint32(header[16:],
+			crc32.ChecksumIEEE(header))
+		if _, err = rw.WriteAt(entries, int64(
+			binary.LittleEndian.Uint64(header[72:]))*sectorSize); err != nil {
+			return
+		}
+		if _, err = rw.WriteAt(header, lba*sectorSize); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadWriterAt is what's needed to update a disk in place
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// readGPTAt reads, and checks, the GPT header at the given LBA, along with
+// its partition entries
+func readGPTAt(r io.ReaderAt, lba int64) (header, entries []byte, err error) {
+	var sector = make([]byte, sectorSize)
+	if _, err = r.ReadAt(sector, lba*sectorSize); err != nil {
+		return nil, nil, fmt.Errorf("unable to read GPT header (%v)", err)
+	}
+	if !bytes.HasPrefix(sector, []byte("EFI PART")) {
+		return nil, nil, fmt.Errorf("no GPT found")
+	}
+	hsize := binary.LittleEndian.Uint32(sector[12:])
+	if hsize < 92 || hsize > sectorSize {
+		return nil, nil, fmt.Errorf("bogus GPT header size (%d)", hsize)
+	}
+	header = sector[:hsize]
+	sum := binary.LittleEndian.Uint32(header[16:])
+	check := append([]byte(nil), header...)
+	binary.LittleEndian.PutUint32(check[16:], 0)
+	if crc32.ChecksumIEEE(check) != sum {
+		return nil, nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+	// entries are 128 bytes, or a bigger multiple of that, long
+	count := int64(binary.LittleEndian.Uint32(header[80:]))
+	size := int64(binary.LittleEndian.Uint32(header[84:]))
+	if size < 128 || size > 4096 || size%128 != 0 || count > 1024 {
+		return nil, nil, fmt.Errorf("bogus GPT (%d entries of %d bytes)",
+			count, size)
+	}
+	entries = make([]byte, count*size)
+	if n, e := r.ReadAt(entries, int64(
+		binary.LittleEndian.Uint64(header[72:]))*sectorSize); e != nil ||
+		int64(n) != count*size {
+		return nil, nil, fmt.Errorf("unable to read GPT entries (%v)", e)
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+		return nil, nil, fmt.Errorf("GPT entries checksum mismatch")
+	}
+	return
+}
+
+// guid formats a GUID as stored on disk, where its first three fields are
+// little endian
+func guid(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+func utf16String(b []byte) string {
+	var u []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return strings.TrimSpace(string(utf16.Decode(u)))
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
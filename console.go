@@ -0,0 +1,359 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	consoleCmd = &cobra.Command{
+		Use:   "console VMid",
+		Short: "Attaches to the serial console of a running CoreOS instance",
+		Long: "Attaches to the serial console of a running CoreOS instance, " +
+			"typically one started in the background, which works even " +
+			"when the VM's network or sshd don't (as in the aftermath of " +
+			"a bad cloud-config).\nAny number of consoles can be attached " +
+			"at once to the same VM, but only the first one gets to type " +
+			"into it. The others (and all that ask for --read_only) just " +
+			"watch. Detaching, with --detach_keys, leaves the VM running.\n" +
+			"With --foreground a VM started in the background gets tied " +
+			"to the terminal, as if it had been started without " +
+			"--detached, until detaching from it.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			engine.rawArgs.BindPFlags(cmd.Flags())
+			if len(args) != 1 {
+				return fmt.Errorf("Incorrect usage. " +
+					"This command requires exactly one argument (a VM's " +
+					"name or UUID).")
+			}
+			return
+		},
+		RunE: consoleCommand,
+		Example: `  corectl console VMid
+  corectl console --detach_keys ctrl-p,ctrl-q VMid
+  corectl console --read_only VMid`,
+	}
+)
+
+// consoleHub fans out a VM's serial console to all the clients attached to
+// it, through a unix socket in its run directory, letting one of them (the
+// writer) type into it
+type consoleHub struct {
+	sync.Mutex
+	pty     io.Writer
+	readers map[net.Conn]bool
+	writer  net.Conn
+}
+
+func serveConsole(path string, pty io.Writer) (hub *consoleHub, err error) {
+	var l net.Listener
+
+	os.Remove(path)
+	if l, err = net.Listen("unix", path); err != nil {
+		return
+	}
+	// only the VM's owner gets to its console
+	if err = os.Chmod(path, 0600); err != nil {
+		return
+	}
+	if err = normalizeOnDiskPermissions(path); err != nil {
+		return
+	}
+	hub = &consoleHub{pty: pty, readers: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				log.Println(e)
+				return
+			}
+			go hub.attach(conn)
+		}
+	}()
+	return
+}
+
+// attach handshakes with a new client, which asks to either read and write
+// ("rw") or just read ("ro"), and tells it back what it got
+func (hub *consoleHub) attach(conn net.Conn) {
+	var (
+		mode string
+		err  error
+	)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if mode, err = readLine(conn); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	hub.Lock()
+	if strings.TrimSpace(mode) == "rw" && hub.writer == nil {
+		hub.writer, mode = conn, "rw"
+	} else {
+		mode = "ro"
+	}
+	// answered before any console output gets its way
+	fmt.Fprintln(conn, mode)
+	hub.readers[conn] = true
+	hub.Unlock()
+
+	if mode == "rw" {
+		io.Copy(hub.pty, conn)
+	} else {
+		io.Copy(ioutil.Discard, conn)
+	}
+	hub.detach(conn)
+}
+
+func (hub *consoleHub) detach(conn net.Conn) {
+	hub.Lock()
+	defer hub.Unlock()
+	if hub.writer == conn {
+		hub.writer = nil
+	}
+	delete(hub.readers, conn)
+	conn.Close()
+}
+
+// Write never fails, with clients that can't keep up being dropped instead
+func (hub *consoleHub) Write(p []byte) (int, error) {
+	hub.Lock()
+	var readers []net.Conn
+	for conn := range hub.readers {
+		readers = append(readers, conn)
+	}
+	hub.Unlock()
+	for _, conn := range readers {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(p); err != nil {
+			hub.detach(conn)
+		}
+	}
+	return len(p), nil
+}
+
+// readLine reads up to a newline, byte by byte, so that nothing past it gets
+// consumed
+func readLine(r io.Reader) (line string, err error) {
+	b := make([]byte, 1)
+	for !strings.HasSuffix(line, "\n") {
+		if _, err = r.Read(b); err != nil {
+			return
+		}
+		line = line + string(b)
+	}
+	return
+}
+
+// parseDetachKeys turns a comma separated list of keys, such as
+// "ctrl-p,ctrl-q", into the byte sequence that they type
+func parseDetachKeys(keys string) (seq []byte, err error) {
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		switch {
+		case len(k) == 1:
+			seq = append(seq, k[0])
+		case len(k) == 6 && strings.HasPrefix(strings.ToLower(k), "ctrl-") &&
+			strings.ContainsRune("abcdefghijklmnopqrstuvwxyz@[\\]^_",
+				rune(strings.ToLower(k)[5])):
+			seq = append(seq, strings.ToUpper(k)[5]&0x1f)
+		default:
+			return nil, fmt.Errorf("Aborting: '%s' isn't a valid detach "+
+				"key (a single character or ctrl-<a-z@[\\]^_>)", k)
+		}
+	}
+	return
+}
+
+func consoleCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		vm         VMInfo
+		detached   bool
+		hangup     func()
+		foreground = engine.rawArgs.GetBool("foreground")
+	)
+
+	if vm, err = vmInfo(args[0]); err != nil {
+		return
+	}
+	if foreground {
+		// it's up to us to halt it, if need be
+		if err = engine.allowedToRun(); err != nil {
+			return
+		}
+		vm.Detached = false
+		if err = vm.storeConfig(); err != nil {
+			return
+		}
+		hangup = func() { vm.halt() }
+		log.Printf("'%s' moved to the foreground\n", vm.Name)
+	}
+	if detached, err = vm.attachConsole(
+		engine.rawArgs.GetString("detach_keys"),
+		engine.rawArgs.GetBool("read_only") && !foreground,
+		0, hangup); err != nil || !foreground || !detached {
+		return
+	}
+	if vm, err = vmInfo(vm.UUID); err != nil {
+		return
+	}
+	vm.Detached = true
+	log.Printf("'%s' moved to the background\n", vm.Name)
+	return vm.storeConfig()
+}
+
+// attachConsole bridges the terminal to the VM's console until either the
+// VM halts or the detach keys get typed, in which case detached is true.
+// the console's socket is waited for up to the given period, and if the
+// terminal goes away in the meantime onHangup, when given, gets called
+func (vm *VMInfo) attachConsole(keys string, readOnly bool,
+	wait time.Duration, onHangup func()) (detached bool, err error) {
+	var (
+		conn    net.Conn
+		seq     []byte
+		mode    string
+		state   *terminal.State
+		fd      = int(os.Stdin.Fd())
+		done    = make(chan error, 3)
+		hup     = make(chan os.Signal, 1)
+		pending []byte
+		path    = filepath.Join(engine.runDir, vm.UUID, "console.sock")
+		timeout = time.Now().Add(wait)
+	)
+
+	if seq, err = parseDetachKeys(keys); err != nil {
+		return
+	}
+	for {
+		if conn, err = net.Dial("unix", path); err == nil ||
+			time.Now().After(timeout) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Aborting: unable to reach '%s' console "+
+			"(%v)", vm.Name, err)
+	}
+	defer conn.Close()
+	if readOnly {
+		fmt.Fprintln(conn, "ro")
+	} else {
+		fmt.Fprintln(conn, "rw")
+	}
+	if mode, err = readLine(conn); err != nil {
+		return
+	}
+	if strings.TrimSpace(mode) == "rw" {
+		log.Printf("attached to '%s' console (detach with %s)\n",
+			vm.Name, keys)
+	} else {
+		log.Printf("watching '%s' console, read-only (quit with %s)\n",
+			vm.Name, keys)
+	}
+
+	if onHangup != nil {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+	if terminal.IsTerminal(fd) {
+		if state, err = terminal.MakeRaw(fd); err != nil {
+			return
+		}
+	}
+	go func() {
+		_, e := io.Copy(os.Stdout, conn)
+		done <- e
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, e := os.Stdin.Read(buf)
+			if e == io.EOF {
+				// nothing else to type, but still something to watch
+				return
+			} else if e != nil {
+				done <- e
+				return
+			}
+			for _, c := range buf[:n] {
+				pending = append(pending, c)
+				if bytes.HasPrefix(seq, pending) {
+					if len(pending) == len(seq) {
+						detached = true
+						done <- nil
+						return
+					}
+					continue
+				}
+				// not the detach sequence after all, so it's the VM's
+				if _, e = conn.Write(pending); e != nil {
+					done <- e
+					return
+				}
+				pending = pending[:0]
+			}
+		}
+	}()
+	select {
+	case err = <-done:
+	case <-hup:
+		log.Printf("terminal gone, halting '%s'\n", vm.Name)
+		onHangup()
+		return
+	}
+	if state != nil {
+		terminal.Restore(fd, state)
+	}
+	fmt.Println()
+	if err == io.EOF {
+		err = nil
+	}
+	if detached {
+		log.Printf("detached from '%s' console\n", vm.Name)
+	}
+	return
+}
+
+func init() {
+	consoleCmd.Flags().String("detach_keys", "ctrl-]",
+		"the key sequence that detaches from the console, as a comma "+
+			"separated list of single characters or ctrl-<key>")
+	consoleCmd.Flags().BoolP("read_only", "r", false,
+		"only watches the console, without typing into it")
+	consoleCmd.Flags().Bool("foreground", false,
+		"moves the VM to the foreground, tying its life to this "+
+			"terminal's, until detaching from it")
+	RootCmd.AddCommand(consoleCmd)
+}
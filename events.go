@@ -0,0 +1,173 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// lifecycle events, as recorded in the journal
+const (
+	EventBoot   = "boot"
+	EventIP     = "ip"
+	EventReady  = "ready"
+	EventHalt   = "halt"
+	EventKill   = "kill"
+	EventExit   = "exit"
+	EventCrash  = "crash"
+	EventFailed = "failed"
+)
+
+var (
+	eventsCmd = &cobra.Command{
+		Use:   "events",
+		Short: "Shows the lifecycle events of CoreOS instances",
+		Long: "Shows the lifecycle events (boots, IP discovery, readiness, " +
+			"halts, hard kills, exits and crashes) of all the CoreOS " +
+			"instances ever run, as recorded in a journal, regardless of who " +
+			"started or stopped them and from where.",
+		PreRunE: defaultPreRunE,
+		RunE:    eventsCommand,
+		Example: `  corectl events --since 24h
+  corectl events --follow --vm containerland`,
+	}
+)
+
+func journalPath() string {
+	return filepath.Join(engine.configDir, "events.log")
+}
+
+// event appends a lifecycle event to the journal, one JSON object per line.
+// failing to do so is never fatal
+func (vm *VMInfo) event(kind, details string) {
+	var (
+		f    *os.File
+		buf  []byte
+		err  error
+		user = os.Getenv("SUDO_USER")
+	)
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if buf, err = json.Marshal(VMEvent{Time: time.Now(), Name: vm.Name,
+		UUID: vm.UUID, Type: kind, User: user,
+		Details: details}); err != nil {
+		log.Println(err)
+		return
+	}
+	if f, err = os.OpenFile(journalPath(),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	// a single write per event, so that concurrent ones never interleave
+	if _, err = f.Write(append(buf, '\n')); err != nil {
+		log.Println(err)
+	}
+	normalizeOnDiskPermissions(journalPath())
+}
+
+func (e VMEvent) String() string {
+	s := fmt.Sprintf("%s %s (%s) %s", e.Time.Format(time.RFC3339), e.Name,
+		e.UUID, e.Type)
+	if e.User != "" {
+		s = s + ", by " + e.User
+	}
+	if e.Details != "" {
+		s = s + ": " + e.Details
+	}
+	return s
+}
+
+func eventsCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		f      *os.File
+		since  time.Time
+		r      *bufio.Reader
+		vm     = engine.rawArgs.GetString("vm")
+		follow = engine.rawArgs.GetBool("follow")
+		asJSON = engine.rawArgs.GetBool("json")
+	)
+
+	if since, err = parseSince(engine.rawArgs.GetString("since")); err != nil {
+		return
+	}
+	for {
+		// with nothing recorded yet, waits for something to be
+		if f, err = os.Open(journalPath()); !os.IsNotExist(err) || !follow {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+
+	r = bufio.NewReader(f)
+	for partial := ""; ; {
+		line, e := r.ReadString('\n')
+		if e == io.EOF {
+			if !follow {
+				return
+			}
+			// lines are written whole, but may be read while at it
+			partial = partial + line
+			time.Sleep(250 * time.Millisecond)
+			continue
+		} else if e != nil {
+			return e
+		}
+		line, partial = partial+line, ""
+
+		var ev VMEvent
+		if json.Unmarshal([]byte(line), &ev) != nil ||
+			ev.Time.Before(since) ||
+			(vm != "" && vm != ev.Name && vm != ev.UUID) {
+			continue
+		}
+		if asJSON {
+			fmt.Print(line)
+		} else {
+			fmt.Println(ev)
+		}
+	}
+}
+
+func init() {
+	eventsCmd.Flags().String("since", "",
+		"only shows events since the given time (RFC 3339) or for the "+
+			"given period (such as 10m or 2h)")
+	eventsCmd.Flags().String("vm", "",
+		"only shows events of the VM with the given name or UUID")
+	eventsCmd.Flags().BoolP("follow", "f", false,
+		"keeps following the journal, as new events get recorded")
+	eventsCmd.Flags().BoolP("json", "j", false,
+		"outputs in JSON (lines) for easy 3rd party integration")
+	RootCmd.AddCommand(eventsCmd)
+}
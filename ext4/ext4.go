@@ -0,0 +1,826 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package ext4 builds ext4 filesystem images, optionally populated with the
+// contents of a host directory, without relying on any external tooling.
+//
+// The images it writes are as plain as ext4 gets: 4K blocks, extents, a
+// journal and sparse superblock backups, no flex_bg, no checksums and no
+// reserved GDT blocks (so they can't be grown online past 16TB, which is
+// ext4's own limit for 32bit block numbers anyway).
+package ext4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	blockSize      = 4096
+	blocksPerGroup = blockSize * 8
+	inodeSize      = 256
+	extraIsize     = 32
+	descSize       = 32
+
+	rootIno    = 2
+	journalIno = 8
+	firstIno   = 11
+
+	maxExtentLen    = 32768
+	inodeExtents    = 4
+	leafExtents     = (blockSize - 12) / 12
+	fastSymlinkSize = 60
+
+	compatHasJournal = 0x4
+	compatDirIndex   = 0x20
+	incompatFiletype = 0x2
+	incompatExtents  = 0x40
+	roCompatSparse   = 0x1
+	roCompatLarge    = 0x2
+	roCompatIsize    = 0x40
+
+	extentsFlag = 0x80000
+	extentMagic = 0xf30a
+	jbd2Magic   = 0xc03b3998
+
+	modeDir     = 0x4000
+	modeRegular = 0x8000
+	modeSymlink = 0xa000
+)
+
+// Options tune the image to build
+type Options struct {
+	// Label is the filesystem's label, up to 16 characters
+	Label string
+	// Size is the image size in bytes. when 0 the image gets sized after
+	// its contents, with some room to spare
+	Size int64
+}
+
+type (
+	run  struct{ start, length uint32 }
+	node struct {
+		ino              uint32
+		mode             uint16
+		links            uint16
+		size             int64
+		mtime            uint32
+		src, target      string
+		entries          []dirent
+		data, leaves     []run
+		contents         [][]byte
+		dataBlocks, meta uint32
+	}
+	dirent struct {
+		name string
+		n    *node
+	}
+	filesystem struct {
+		out               *os.File
+		blocks, groups    uint32
+		inodesPerGroup    uint32
+		gdtBlocks, itable uint32
+		journalBlocks     uint32
+		bitmap            []byte
+		cursor            uint32
+		nodes             []*node
+		uuid              [16]byte
+		hashSeed          [16]byte
+		label             string
+		now               uint32
+	}
+)
+
+// Build writes into path an ext4 filesystem image holding the contents of
+// the host directory dir, or an empty one if dir is "". it returns the
+// image's size
+func Build(path, dir string, opts Options) (size int64, err error) {
+	var (
+		fs   = &filesystem{label: opts.Label, now: uint32(time.Now().Unix())}
+		root *node
+		lost = &node{ino: firstIno, mode: modeDir | 0700, links: 2,
+			mtime: fs.now}
+		need   uint32
+		inodes uint32
+	)
+
+	if len(opts.Label) > 16 {
+		return 0, fmt.Errorf("'%s' is too long for a label "+
+			"(16 characters at most)", opts.Label)
+	}
+	if _, err = rand.Read(fs.uuid[:]); err != nil {
+		return
+	}
+	// a random (version 4) UUID
+	fs.uuid[6], fs.uuid[8] = fs.uuid[6]&0x0f|0x40, fs.uuid[8]&0x3f|0x80
+	if _, err = rand.Read(fs.hashSeed[:]); err != nil {
+		return
+	}
+	if root, err = fs.scan(dir); err != nil {
+		return
+	}
+	// lost+found gets 4 blocks, as mke2fs does, so that e2fsck has room
+	lost.entries = []dirent{{".", lost}, {"..", root}}
+	lost.contents = dirBlocks(lost.entries)
+	for len(lost.contents) < 4 {
+		lost.contents = append(lost.contents, emptyDirBlock())
+	}
+	root.entries = append(root.entries, dirent{"lost+found", lost})
+	root.links++
+	root.contents = dirBlocks(root.entries)
+	fs.nodes = append(fs.nodes, lost)
+
+	for _, n := range fs.nodes {
+		need += n.blocks()
+		if n.ino > inodes {
+			inodes = n.ino
+		}
+	}
+	if err = fs.layout(opts.Size, need, inodes); err != nil {
+		return
+	}
+	size = int64(fs.blocks) * blockSize
+
+	if fs.out, err = os.OpenFile(path,
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	defer func() {
+		if e := fs.out.Close(); err == nil {
+			err = e
+		}
+	}()
+	// sparse, only what's actually written takes space on the host
+	if err = fs.out.Truncate(size); err != nil {
+		return
+	}
+	journal := &node{ino: journalIno, mode: modeRegular | 0600, links: 1,
+		size: int64(fs.journalBlocks) * blockSize, mtime: fs.now}
+	if fs.journalBlocks > 0 {
+		fs.nodes = append([]*node{journal}, fs.nodes...)
+	}
+	for _, n := range fs.nodes {
+		if err = fs.allocate(n); err != nil {
+			return
+		}
+	}
+	for _, n := range fs.nodes {
+		if err = fs.writeData(n); err != nil {
+			return
+		}
+	}
+	if fs.journalBlocks > 0 {
+		if err = fs.writeBlock(journal.data[0].start,
+			fs.journalSuperblock()); err != nil {
+			return
+		}
+	}
+	return size, fs.writeMetadata(journal)
+}
+
+// scan walks the host directory, assigning inodes to everything within
+func (fs *filesystem) scan(dir string) (root *node, err error) {
+	var (
+		next     uint32 = firstIno + 1
+		dirs            = make(map[string]*node)
+		hardlink        = make(map[[2]uint64]*node)
+	)
+
+	root = &node{ino: rootIno, mode: modeDir | 0755, links: 2, mtime: fs.now}
+	root.entries = []dirent{{".", root}, {"..", root}}
+	fs.nodes = append(fs.nodes, root)
+	if dir == "" {
+		return
+	}
+	dirs[filepath.Clean(dir)] = root
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, e error) error {
+		if e != nil {
+			return e
+		}
+		var (
+			n      *node
+			parent = dirs[filepath.Dir(p)]
+			perm   = uint16(fi.Mode().Perm())
+		)
+		if filepath.Clean(p) == filepath.Clean(dir) {
+			root.mode, root.mtime = modeDir|perm, epoch(fi.ModTime())
+			return nil
+		}
+		if fi.Mode()&os.ModeSetuid != 0 {
+			perm |= 0x800
+		}
+		if fi.Mode()&os.ModeSetgid != 0 {
+			perm |= 0x400
+		}
+		if fi.Mode()&os.ModeSticky != 0 {
+			perm |= 0x200
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() {
+			key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if n = hardlink[key]; n != nil {
+				n.links++
+				parent.entries = append(parent.entries,
+					dirent{fi.Name(), n})
+				return nil
+			}
+			defer func() { hardlink[key] = n }()
+		}
+		n = &node{ino: next, links: 1, mtime: epoch(fi.ModTime())}
+		switch {
+		case fi.IsDir():
+			n.mode, n.links = modeDir|perm, 2
+			n.entries = []dirent{{".", n}, {"..", parent}}
+			parent.links++
+			dirs[filepath.Clean(p)] = n
+		case fi.Mode().IsRegular():
+			n.mode, n.src, n.size = modeRegular|perm, p, fi.Size()
+		case fi.Mode()&os.ModeSymlink != 0:
+			if n.target, e = os.Readlink(p); e != nil {
+				return e
+			}
+			n.mode, n.size = modeSymlink|0777, int64(len(n.target))
+		default:
+			return fmt.Errorf("%s: only directories, regular files and "+
+				"symlinks can be copied into the image", p)
+		}
+		next++
+		parent.entries = append(parent.entries, dirent{fi.Name(), n})
+		fs.nodes = append(fs.nodes, n)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, n := range fs.nodes {
+		if n.mode&0xf000 == modeDir && n != root {
+			n.contents = dirBlocks(n.entries)
+		}
+	}
+	return
+}
+
+// blocks returns how many data blocks the node needs, not counting the
+// extent tree leaves it may end needing
+func (n *node) blocks() uint32 {
+	switch n.mode & 0xf000 {
+	case modeDir:
+		return uint32(len(n.contents))
+	case modeSymlink:
+		if n.size < fastSymlinkSize {
+			return 0
+		}
+	}
+	return uint32((n.size + blockSize - 1) / blockSize)
+}
+
+func epoch(t time.Time) uint32 {
+	if t.Unix() < 0 {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+func hasSuper(group uint32) bool {
+	if group <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		g := group
+		for g%base == 0 {
+			g = g / base
+		}
+		if g == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// groupStart returns the first block of the given group and its overhead,
+// superblock, group descriptors, bitmaps and inode table included
+func (fs *filesystem) groupStart(g uint32) (start, overhead uint32) {
+	start, overhead = g*blocksPerGroup, 2+fs.itable
+	if hasSuper(g) {
+		overhead += 1 + fs.gdtBlocks
+	}
+	return
+}
+
+// layout settles the geometry of the filesystem, marking as used the blocks
+// that hold its metadata
+func (fs *filesystem) layout(size int64, need, inodes uint32) (err error) {
+	var fixed = size > 0
+
+	if !fixed {
+		// 10% on top of the contents, and a minimum of 64M
+		size = (int64(need)*blockSize*11/10 + 64<<20) >> 20 << 20
+	}
+	for {
+		fs.blocks = uint32(size / blockSize)
+		if size/blockSize >= 1<<32 {
+			return fmt.Errorf("images can't be larger than 16TB")
+		}
+		if fs.journalBlocks = 0; fs.blocks >= 4096 {
+			fs.journalBlocks = fs.blocks / 64
+			if fs.journalBlocks < 1024 {
+				fs.journalBlocks = 1024
+			} else if fs.journalBlocks > maxExtentLen {
+				fs.journalBlocks = maxExtentLen
+			}
+		}
+		fs.groups = (fs.blocks + blocksPerGroup - 1) / blocksPerGroup
+		fs.gdtBlocks = (fs.groups*descSize + blockSize - 1) / blockSize
+		// as mke2fs, one inode per 16K of disk, in whole inode table blocks
+		ipg := (fs.blocks/fs.groups*blockSize/16384 + 15) / 16 * 16
+		if min := (inodes + fs.groups - 1) / fs.groups; ipg < min {
+			ipg = (min + 15) / 16 * 16
+		}
+		if ipg > blocksPerGroup {
+			return fmt.Errorf("too many files to fit in the image")
+		}
+		fs.inodesPerGroup, fs.itable = ipg, ipg*inodeSize/blockSize
+
+		// a last group too small to be useful gets dropped
+		last := fs.blocks - (fs.groups-1)*blocksPerGroup
+		if _, overhead := fs.groupStart(fs.groups - 1); last < overhead+256 {
+			if fs.groups == 1 {
+				return fmt.Errorf("%v bytes is too small for an image",
+					size)
+			}
+			size = int64(fs.blocks-last) * blockSize
+			continue
+		}
+
+		var overhead uint32
+		for g := uint32(0); g < fs.groups; g++ {
+			_, o := fs.groupStart(g)
+			overhead += o
+		}
+		// each extent tree leaf holds 340 extents, so this is plenty
+		if want := need + fs.journalBlocks + need/1024 +
+			overhead; want > fs.blocks {
+			if fixed {
+				return fmt.Errorf("contents don't fit in %v bytes "+
+					"(at least %v are needed)", size,
+					int64(want)*blockSize)
+			}
+			size = (int64(want)*blockSize*11/10 + 64<<20) >> 20 << 20
+			continue
+		}
+		break
+	}
+
+	fs.bitmap = make([]byte, fs.groups*blocksPerGroup/8)
+	for g := uint32(0); g < fs.groups; g++ {
+		start, overhead := fs.groupStart(g)
+		for b := start; b < start+overhead; b++ {
+			fs.mark(b)
+		}
+	}
+	for b := fs.blocks; b < fs.groups*blocksPerGroup; b++ {
+		fs.mark(b)
+	}
+	return
+}
+
+func (fs *filesystem) mark(block uint32) {
+	fs.bitmap[block/8] |= 1 << (block % 8)
+}
+
+func (fs *filesystem) isUsed(block uint32) bool {
+	return fs.bitmap[block/8]&(1<<(block%8)) != 0
+}
+
+// alloc hands out count blocks, as contiguous as possible
+func (fs *filesystem) alloc(count uint32) (runs []run, err error) {
+	for count > 0 {
+		for fs.cursor < fs.blocks && fs.isUsed(fs.cursor) {
+			fs.cursor++
+		}
+		if fs.cursor >= fs.blocks {
+			return runs, fmt.Errorf("image ran out of space")
+		}
+		r := run{start: fs.cursor}
+		for count > 0 && fs.cursor < fs.blocks && !fs.isUsed(fs.cursor) &&
+			r.length < maxExtentLen {
+			fs.mark(fs.cursor)
+			fs.cursor, r.length, count = fs.cursor+1, r.length+1, count-1
+		}
+		runs = append(runs, r)
+	}
+	return
+}
+
+func (fs *filesystem) allocate(n *node) (err error) {
+	var leaves []run
+	if n.dataBlocks = n.blocks(); n.dataBlocks == 0 {
+		return
+	}
+	if n.data, err = fs.alloc(n.dataBlocks); err != nil {
+		return
+	}
+	if len(n.data) > inodeExtents {
+		count := uint32((len(n.data) + leafExtents - 1) / leafExtents)
+		if count > inodeExtents {
+			return fmt.Errorf("'%s' is too fragmented", n.src)
+		}
+		if leaves, err = fs.alloc(count); err != nil {
+			return
+		}
+		for _, l := range leaves {
+			for i := uint32(0); i < l.length; i++ {
+				n.leaves = append(n.leaves, run{l.start + i, 1})
+			}
+		}
+		n.meta = count
+	}
+	return
+}
+
+func (fs *filesystem) writeBlock(block uint32, buf []byte) (err error) {
+	_, err = fs.out.WriteAt(buf, int64(block)*blockSize)
+	return
+}
+
+func (fs *filesystem) writeData(n *node) (err error) {
+	var in *os.File
+
+	for i, l := range n.leaves {
+		first := i * leafExtents
+		last := first + leafExtents
+		if last > len(n.data) {
+			last = len(n.data)
+		}
+		if err = fs.writeBlock(l.start,
+			extentNode(n.data[first:last], logical(n.data, first),
+				leafExtents)); err != nil {
+			return
+		}
+	}
+	switch {
+	case n.contents != nil:
+		var i int
+		for _, r := range n.data {
+			for b := uint32(0); b < r.length; b, i = b+1, i+1 {
+				if err = fs.writeBlock(r.start+b,
+					n.contents[i]); err != nil {
+					return
+				}
+			}
+		}
+	case n.mode&0xf000 == modeSymlink && n.dataBlocks > 0:
+		buf := make([]byte, blockSize)
+		copy(buf, n.target)
+		err = fs.writeBlock(n.data[0].start, buf)
+	case n.src != "":
+		if in, err = os.Open(n.src); err != nil {
+			return
+		}
+		defer in.Close()
+		err = fs.copyFile(in, n)
+	}
+	return
+}
+
+// copyFile streams a host file into the node's blocks, leaving as holes
+// the blocks that are all zeroes
+func (fs *filesystem) copyFile(in io.Reader, n *node) (err error) {
+	var (
+		buf    = make([]byte, 64*blockSize)
+		zeroes = make([]byte, len(buf))
+		left   = n.size
+	)
+	for _, r := range n.data {
+		offset := int64(r.start) * blockSize
+		for remaining := int64(r.length) * blockSize; remaining > 0 &&
+			left > 0; {
+			chunk := int64(len(buf))
+			if chunk > remaining {
+				chunk = remaining
+			}
+			if chunk > left {
+				chunk = left
+			}
+			if _, err = io.ReadFull(in, buf[:chunk]); err != nil {
+				return fmt.Errorf("%s changed while being copied (%v)",
+					n.src, err)
+			}
+			if !bytes.Equal(buf[:chunk], zeroes[:chunk]) {
+				if _, err = fs.out.WriteAt(buf[:chunk],
+					offset); err != nil {
+					return
+				}
+			}
+			offset, remaining, left = offset+chunk, remaining-chunk,
+				left-chunk
+		}
+	}
+	return
+}
+
+// logical returns the logical block where the i-th run starts
+func logical(runs []run, i int) (block uint32) {
+	for _, r := range runs[:i] {
+		block += r.length
+	}
+	return
+}
+
+// extentNode lays out an extent tree node, with room for max entries,
+// pointing at the given runs
+func extentNode(runs []run, first uint32, max int) []byte {
+	buf := make([]byte, 12+12*max)
+	if max == leafExtents {
+		buf = make([]byte, blockSize)
+	}
+	binary.LittleEndian.PutUint16(buf[0:], extentMagic)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(runs)))
+	binary.LittleEndian.PutUint16(buf[4:], uint16(max))
+	for i, r := range runs {
+		e := buf[12+12*i:]
+		binary.LittleEndian.PutUint32(e[0:], first)
+		binary.LittleEndian.PutUint16(e[4:], uint16(r.length))
+		binary.LittleEndian.PutUint32(e[8:], r.start)
+		first += r.length
+	}
+	return buf
+}
+
+// iBlock returns the contents of the inode's i_block field: either the
+// root of its extent tree or, for short symlinks, the link target
+func (n *node) iBlock() []byte {
+	if n.mode&0xf000 == modeSymlink && n.dataBlocks == 0 {
+		buf := make([]byte, fastSymlinkSize)
+		copy(buf, n.target)
+		return buf
+	}
+	if len(n.leaves) == 0 {
+		return extentNode(n.data, 0, inodeExtents)
+	}
+	buf := extentNode(nil, 0, inodeExtents)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(n.leaves)))
+	binary.LittleEndian.PutUint16(buf[6:], 1)
+	for i, l := range n.leaves {
+		idx := buf[12+12*i:]
+		binary.LittleEndian.PutUint32(idx[0:], logical(n.data, i*leafExtents))
+		binary.LittleEndian.PutUint32(idx[4:], l.start)
+	}
+	return buf
+}
+
+func (n *node) inode() []byte {
+	buf := make([]byte, inodeSize)
+	if n.mode&0xf000 == modeDir {
+		n.size = int64(len(n.contents)) * blockSize
+	}
+	binary.LittleEndian.PutUint16(buf[0x0:], n.mode)
+	binary.LittleEndian.PutUint32(buf[0x4:], uint32(n.size))
+	for _, at := range []int{0x8, 0xc, 0x10} {
+		binary.LittleEndian.PutUint32(buf[at:], n.mtime)
+	}
+	binary.LittleEndian.PutUint16(buf[0x1a:], n.links)
+	binary.LittleEndian.PutUint32(buf[0x1c:],
+		(n.dataBlocks+n.meta)*blockSize/512)
+	if !(n.mode&0xf000 == modeSymlink && n.dataBlocks == 0) {
+		binary.LittleEndian.PutUint32(buf[0x20:], extentsFlag)
+	}
+	copy(buf[0x28:0x64], n.iBlock())
+	binary.LittleEndian.PutUint32(buf[0x6c:], uint32(n.size>>32))
+	binary.LittleEndian.PutUint16(buf[0x80:], extraIsize)
+	binary.LittleEndian.PutUint32(buf[0x90:], n.mtime)
+	return buf
+}
+
+// dirBlocks lays out directory entries, linearly, into whole blocks
+func dirBlocks(entries []dirent) (blocks [][]byte) {
+	var (
+		buf  []byte
+		used int
+		last int
+	)
+	for _, e := range entries {
+		length := (8 + len(e.name) + 3) / 4 * 4
+		if buf == nil || used+length > blockSize {
+			if buf != nil {
+				stretch(buf, last, used)
+			}
+			buf, used = make([]byte, blockSize), 0
+			blocks = append(blocks, buf)
+		}
+		binary.LittleEndian.PutUint32(buf[used:], e.n.ino)
+		binary.LittleEndian.PutUint16(buf[used+4:], uint16(length))
+		buf[used+6] = uint8(len(e.name))
+		buf[used+7] = fileType(e.n.mode)
+		copy(buf[used+8:], e.name)
+		last, used = used, used+length
+	}
+	stretch(buf, last, used)
+	return
+}
+
+// stretch makes the last entry of a directory block span until its end
+func stretch(buf []byte, last, used int) {
+	length := binary.LittleEndian.Uint16(buf[last+4:])
+	binary.LittleEndian.PutUint16(buf[last+4:],
+		length+uint16(blockSize-used))
+}
+
+func emptyDirBlock() []byte {
+	buf := make([]byte, blockSize)
+	binary.LittleEndian.PutUint16(buf[4:], blockSize)
+	return buf
+}
+
+func fileType(mode uint16) uint8 {
+	switch mode & 0xf000 {
+	case modeRegular:
+		return 1
+	case modeDir:
+		return 2
+	case modeSymlink:
+		return 7
+	}
+	return 0
+}
+
+func (fs *filesystem) journalSuperblock() []byte {
+	buf := make([]byte, blockSize)
+	binary.BigEndian.PutUint32(buf[0x0:], jbd2Magic)
+	binary.BigEndian.PutUint32(buf[0x4:], 4) // superblock v2
+	binary.BigEndian.PutUint32(buf[0xc:], blockSize)
+	binary.BigEndian.PutUint32(buf[0x10:], fs.journalBlocks)
+	binary.BigEndian.PutUint32(buf[0x14:], 1)
+	binary.BigEndian.PutUint32(buf[0x18:], 1)
+	copy(buf[0x30:], fs.uuid[:])
+	binary.BigEndian.PutUint32(buf[0x40:], 1)
+	return buf
+}
+
+// writeMetadata writes inode tables, bitmaps, group descriptors and the
+// superblock, along with its backups
+func (fs *filesystem) writeMetadata(journal *node) (err error) {
+	var (
+		gdt                    = make([]byte, fs.gdtBlocks*blockSize)
+		freeBlocks, freeInodes uint32
+		ipg                    = fs.inodesPerGroup
+		empty                  = make([]byte, blockSize)
+	)
+
+	for g := uint32(0); g < fs.groups; g++ {
+		var (
+			start, overhead = fs.groupStart(g)
+			inodeBitmap     = make([]byte, blockSize)
+			table           = make([]byte, fs.itable*blockSize)
+			blockBitmap     = fs.bitmap[g*blocksPerGroup/8 : (g+1)*blocksPerGroup/8]
+			free, dirs      uint32
+			freeI           = ipg
+			meta            = start + overhead - 2 - fs.itable
+		)
+		for ino := g*ipg + 1; ino <= (g+1)*ipg; ino++ {
+			if ino < firstIno {
+				inodeBitmap[(ino-1-g*ipg)/8] |= 1 << ((ino - 1 - g*ipg) % 8)
+				freeI--
+			}
+		}
+		for _, n := range fs.nodes {
+			if (n.ino-1)/ipg != g {
+				continue
+			}
+			i := n.ino - 1 - g*ipg
+			if n.ino >= firstIno {
+				inodeBitmap[i/8] |= 1 << (i % 8)
+				freeI--
+			}
+			if n.mode&0xf000 == modeDir {
+				dirs++
+			}
+			copy(table[i*inodeSize:], n.inode())
+		}
+		for i := ipg; i < blockSize*8; i++ {
+			inodeBitmap[i/8] |= 1 << (i % 8)
+		}
+		for i := uint32(0); i < blocksPerGroup; i++ {
+			if blockBitmap[i/8]&(1<<(i%8)) == 0 {
+				free++
+			}
+		}
+		if err = fs.writeBlock(meta, blockBitmap); err != nil {
+			return
+		}
+		if err = fs.writeBlock(meta+1, inodeBitmap); err != nil {
+			return
+		}
+		// the inode table is mostly empty, and its blocks that are all
+		// zeroes already read as such from the sparse image
+		for b := uint32(0); b < fs.itable; b++ {
+			block := table[b*blockSize : (b+1)*blockSize]
+			if bytes.Equal(block, empty) {
+				continue
+			}
+			if err = fs.writeBlock(meta+2+b, block); err != nil {
+				return
+			}
+		}
+		d := gdt[g*descSize:]
+		binary.LittleEndian.PutUint32(d[0x0:], meta)
+		binary.LittleEndian.PutUint32(d[0x4:], meta+1)
+		binary.LittleEndian.PutUint32(d[0x8:], meta+2)
+		binary.LittleEndian.PutUint16(d[0xc:], uint16(free))
+		binary.LittleEndian.PutUint16(d[0xe:], uint16(freeI))
+		binary.LittleEndian.PutUint16(d[0x10:], uint16(dirs))
+		freeBlocks, freeInodes = freeBlocks+free, freeInodes+freeI
+	}
+
+	for g := uint32(0); g < fs.groups; g++ {
+		if !hasSuper(g) {
+			continue
+		}
+		start, _ := fs.groupStart(g)
+		sb := fs.superblock(g, freeBlocks, freeInodes, journal)
+		offset := int64(start) * blockSize
+		if g == 0 {
+			// the primary superblock sits after the boot sector
+			offset = 1024
+		}
+		if _, err = fs.out.WriteAt(sb, offset); err != nil {
+			return
+		}
+		if err = fs.writeBlock(start+1, gdt); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (fs *filesystem) superblock(group, freeBlocks, freeInodes uint32,
+	journal *node) []byte {
+	var (
+		buf    = make([]byte, 1024)
+		compat = uint32(compatDirIndex)
+		le32   = func(at int, v uint32) {
+			binary.LittleEndian.PutUint32(buf[at:], v)
+		}
+		le16 = func(at int, v uint16) {
+			binary.LittleEndian.PutUint16(buf[at:], v)
+		}
+	)
+	le32(0x0, fs.inodesPerGroup*fs.groups)
+	le32(0x4, fs.blocks)
+	le32(0xc, freeBlocks)
+	le32(0x10, freeInodes)
+	le32(0x18, 2) // 1024 << 2
+	le32(0x1c, 2)
+	le32(0x20, blocksPerGroup)
+	le32(0x24, blocksPerGroup)
+	le32(0x28, fs.inodesPerGroup)
+	le32(0x30, fs.now)
+	le16(0x36, 0xffff)
+	le16(0x38, 0xef53)
+	le16(0x3a, 1) // clean
+	le16(0x3c, 1) // on errors, continue
+	le32(0x40, fs.now)
+	le32(0x4c, 1) // dynamic revision
+	le32(0x54, firstIno)
+	le16(0x58, inodeSize)
+	le16(0x5a, uint16(group))
+	if fs.journalBlocks > 0 {
+		compat |= compatHasJournal
+		le32(0xe0, journalIno)
+		copy(buf[0x10c:], journal.iBlock())
+		le32(0x148, uint32(journal.size>>32))
+		le32(0x14c, uint32(journal.size))
+		buf[0xfd] = 1 // s_jnl_blocks holds a backup of the journal inode
+	}
+	le32(0x5c, compat)
+	le32(0x60, incompatFiletype|incompatExtents)
+	le32(0x64, roCompatSparse|roCompatLarge|roCompatIsize)
+	copy(buf[0x68:], fs.uuid[:])
+	copy(buf[0x78:0x88], fs.label)
+	copy(buf[0xec:], fs.hashSeed[:])
+	buf[0xfc] = 1 // half_md4
+	le32(0x108, fs.now)
+	le16(0x15c, extraIsize)
+	le16(0x15e, extraIsize)
+	le32(0x160, 1) // signed directory hash
+	return buf
+}
@@ -18,27 +18,41 @@ package main
 import (
 	"time"
 
+	"github.com/TheNewNormal/corectl/bootdisk"
 	"github.com/spf13/viper"
 )
 
-const LatestImageBreackage = "2016-01-28T18:45:00WET"
+const LatestImageBreackage = "2026-10-19T09:10:00WET"
+
+// vmSchemaVersion is the layout of the VMs' state files (runDir/<UUID>/config)
+// that this build writes. bumping it requires appending, to vmMigrations, the
+// step from the previous layout
+const vmSchemaVersion = 2
 
 type (
 	vmContext      struct{ vm *VMInfo }
 	sessionContext struct {
-		configDir, imageDir, runDir, tmpDir, pwd, uid, gid, homedir string
-		address, netmask, network                                   string
-		hasPowers, debug, json                                      bool
-		rawArgs                                                     *viper.Viper
-		VMs                                                         []vmContext
+		configDir, imageDir, runDir, tmpDir, volumeDir, pwd string
+		uid, gid, homedir                                   string
+		address, netmask, network                           string
+		hasPowers, debug, json                              bool
+		rawArgs                                             *viper.Viper
+		VMs                                                 []vmContext
 	}
 	// VMInfo - per VM settings
 	VMInfo struct {
+		SchemaVersion                          int
 		Name, Channel, Version                 string
 		Cpus, Memory                           int
 		UUID, MacAddress                       string
-		CloudConfig, CClocation, SSHkey, Extra string `json:",omitempty"`
-		Root                                   int
+		CloudConfig, CClocation, SSHkey, Extra string   `json:",omitempty"`
+		CCsum, Profile                         string   `json:",omitempty"`
+		Kernel, Initrd                         string   `json:",omitempty"`
+		KernelArgs                             []string `json:",omitempty"`
+		// how the VM boots (pxe or disk) and, if from its root volume, off
+		// which of its /usr partitions
+		Boot, BootSlot                         string `json:",omitempty"`
+		Root, Index                            int
 		Ethernet                               []NetworkInterface
 		Storage                                storageAssets
 		InternalSSHauthKey, InternalSSHprivKey string
@@ -46,20 +60,57 @@ type (
 		Pid                                    int
 		PublicIP                               string
 		CreatedAt                              time.Time
+		Forwarders                             []Forwarder `json:",omitempty"` // filled in by ps
 		publicIP                               chan string
 		errch                                  chan error
 		done                                   chan bool
+		readiness                              []readyCheck
+		diskBoot                               *bootdisk.Boot
+	}
+	// VolumeInfo - per volume settings
+	VolumeInfo struct {
+		Name, Label, Path string
+		Size, Allocated   int64
+		CreatedAt         time.Time
+		Origin            string   `json:",omitempty"`
+		GrowFS            bool     `json:",omitempty"`
+		Snapshots         []string `json:",omitempty"`
+		HeldBy            string   `json:",omitempty"`
+	}
+	// VMEvent - a lifecycle event, as recorded in the journal
+	VMEvent struct {
+		Time             time.Time
+		Name, UUID, Type string
+		User             string
+		Details          string `json:",omitempty"`
+	}
+	// Reservation - the UUID (and so MAC and IP) kept for a VM name
+	Reservation struct {
+		Name, UUID, MacAddress string
+		PublicIP               string `json:",omitempty"`
+		LastUsed               time.Time
+	}
+	// Forwarder - a port forward, running in the background, to a VM
+	Forwarder struct {
+		Pid       int
+		Specs     []string
+		StartedAt time.Time
 	}
 	// NetworkInterface ...
 	NetworkInterface struct {
 		Type int
 		// if tap
 		Path string `json:",omitempty"`
+		// static settings, if any, as IP/PREFIX and IPs
+		Address, Gateway string   `json:",omitempty"`
+		DNS              []string `json:",omitempty"`
 	}
 	// StorageDevice ...
 	StorageDevice struct {
 		Slot       int
 		Type, Path string
+		// if a throwaway clone of a snapshot
+		Snapshot string `json:",omitempty"`
 	}
 	storageAssets struct {
 		CDDrives, HardDrives map[string]StorageDevice `json:",omitempty"`
@@ -68,6 +119,11 @@ type (
 
 var DefaultChannels = []string{"alpha", "beta", "stable"}
 
+// the kernel command line that every VM gets, unless told otherwise
+var defaultKernelArgs = []string{
+	"earlyprintk=serial", "console=ttyS0", "coreos.autologin",
+}
+
 const (
 	_ = iota
 	Raw
@@ -76,6 +132,8 @@ const (
 	CDROM        = "CDROM"
 	Local        = "localfs"
 	Remote       = "URL"
+	PXE          = "pxe"
+	Disk         = "disk"
 	Attached     = true
 	Detached     = false
 	HelpTemplate = `{{ $cmd := . }}
@@ -333,33 +391,42 @@ K9w3EiyDrgzl0IpotQXxOBGHoCtcxUZvkNeOIxAb8QwkWnhgkljMyQ==
 [[ $(</proc/cmdline) =~ uuid=([^\ ]+) ]]; UUID=${BASH_REMATCH[1]}
 [[ $(</proc/cmdline) =~ endpoint=([^\ ]+) ]]; endpoint=${BASH_REMATCH[1]}
 
-# wait for eth0 to get up...
+# waits for the given interface to get an address, for up to ${2} tenths of a
+# second if given, or forever
 get_ipv4() {
-    IFACE="${1}"
-    local ip
-    while [ -z "${ip}" ]; do
-        ip=$(ip -4 -o addr show dev "${IFACE}" scope global | \
-            gawk '{split ($4, out, "/"); print out[1]}')
-        sleep .1
+    local iface="${1}" wait="${2:--1}" ip
+    while [ -z "${ip}" ] && [ "${wait}" -ne 0 ]; do
+        ip=$(ip -4 -o addr show dev "${iface}" scope global | \
+            gawk '{split ($4, out, "/"); print out[1]}' | head -n1)
+        [ -n "${ip}" ] || { sleep .1; wait=$((wait - 1)); }
     done
     echo "${ip}"
 }
 
-COREOS_PUBLIC_IPV4=$(get_ipv4 eth0)
-# XXX if/when i get tap right
-COREOS_PRIVATE_IPV4=${COREOS_PUBLIC_IPV4}
-
+get_ipv4 eth0 > /dev/null
 block-until-url "${endpoint}"
 
+# one shot steps driven from the host, such as growing filesystems or
+# setting static network settings (which also tells the private interface)
+source <(curl -Ls ${endpoint}/setup)
+
+COREOS_PUBLIC_IPV4=$(get_ipv4 eth0)
+# taps without DHCP, nor a static address, may never get one, so that's
+# waited for only briefly, as the host gives up on VMs not calling back in 30s
+COREOS_PRIVATE_IPV4=$(get_ipv4 "${PRIVATE_IFACE:-eth0}" 50)
+[ -n "${COREOS_PRIVATE_IPV4}" ] || COREOS_PRIVATE_IPV4=${COREOS_PUBLIC_IPV4}
+
 HOSTNAME="$(curl -Ls ${endpoint}/hostname)"
 HOMEDIR="$(curl -Ls ${endpoint}/homedir)"
 NFS="$(curl -Ls ${endpoint}/nfs)"
+INDEX="$(curl -Ls ${endpoint}/index)"
 
 ( echo endpoint=${endpoint}
   echo UUID=${UUID}
   echo HOSTNAME="${HOSTNAME}"
   echo HOMEDIR="${HOMEDIR}"
   echo NFS="${NFS}"
+  echo INDEX="${INDEX}"
 
   echo COREOS_PUBLIC_IPV4=${COREOS_PUBLIC_IPV4}
   echo COREOS_PRIVATE_IPV4=${COREOS_PRIVATE_IPV4}
@@ -374,6 +441,25 @@ echo "$(curl -Ls ${endpoint}/sshKey)" | update-ssh-keys -a proc-cmdline-ssh_inte
 
 `
 	//
+	// grows, in place, the ext4 or btrfs filesystem of the given device
+	CoreOEMgrowFS = `grow_fs() {
+    local dev="${1}" mnt
+    case "$(blkid -o value -s TYPE "${dev}")" in
+    ext2|ext3|ext4)
+        findmnt -n "${dev}" > /dev/null || e2fsck -fp "${dev}"
+        resize2fs "${dev}" ;;
+    btrfs)
+        mnt="$(findmnt -n -o TARGET "${dev}" | head -n1)"
+        if [ -n "${mnt}" ]; then
+            btrfs filesystem resize max "${mnt}"
+        else
+            mnt="$(mktemp -d)"
+            mount "${dev}" "${mnt}" && btrfs filesystem resize max "${mnt}"
+            umount "${mnt}"; rmdir "${mnt}"
+        fi ;;
+    esac
+}
+`
 	CoreOEMsetupBootstrap = `#cloud-config
 
 coreos:
@@ -81,6 +81,7 @@ func (vm VMInfo) halt() (err error) {
 				}
 				if p, ee := os.FindProcess(vm.Pid); ee == nil {
 					log.Println("hard kill...")
+					vm.event(EventKill, e.Error())
 					if err = p.Signal(os.Interrupt); err != nil {
 						return
 					}
@@ -95,10 +96,13 @@ func (vm VMInfo) halt() (err error) {
 		}
 	} else {
 		defer sshSession.close()
-		if err =
-			hardKill(sshSession.executeRemoteCommand(command)); err != nil {
+		e := sshSession.executeRemoteCommand(command)
+		if err = hardKill(e); err != nil {
 			return
 		}
+		if e == nil {
+			vm.event(EventHalt, "")
+		}
 	}
 	// wait until it's _really_ dead, but not forever
 	for {
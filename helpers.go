@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/binary"
@@ -38,6 +39,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/rakyll/pb"
@@ -47,6 +49,7 @@ import (
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/clearsign"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
 )
 
 // (recursively) fix permissions on path
@@ -63,6 +66,50 @@ func normalizeOnDiskPermissions(path string) (err error) {
 	return filepath.Walk(path, action)
 }
 
+// writeFileAtomic is as ioutil.WriteFile but, by writing to a temporary
+// file first and then renaming it over, readers never see it half written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(filepath.Dir(path),
+		"."+filepath.Base(path)); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseSince turns either a RFC 3339 timestamp or a period (such as 10m,
+// meaning the last ten minutes) into the moment it refers to
+func parseSince(s string) (since time.Time, err error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return
+	}
+	if d, e := time.ParseDuration(s); e == nil {
+		return time.Now().Add(-d), nil
+	}
+	if since, err = time.Parse(time.RFC3339, s); err != nil {
+		err = fmt.Errorf("Aborting: '%s' is neither a duration (such "+
+			"as 10m) nor a RFC 3339 timestamp", s)
+	}
+	return
+}
+
 func pSlice(plain []string) []string {
 	var sliced []string
 	for _, x := range plain {
@@ -287,6 +334,7 @@ func (session *sessionContext) init() (err error) {
 	session.imageDir = filepath.Join(session.configDir, "/images/")
 	session.runDir = filepath.Join(session.configDir, "/running/")
 	session.tmpDir = filepath.Join(session.configDir, "/tmp/")
+	session.volumeDir = filepath.Join(session.configDir, "/volumes/")
 
 	session.uid, session.gid = caller.Uid, caller.Gid
 	session.homedir = caller.HomeDir
@@ -308,6 +356,9 @@ func (session *sessionContext) init() (err error) {
 	if err = os.MkdirAll(session.tmpDir, 0755); err != nil {
 		return
 	}
+	if err = os.MkdirAll(session.volumeDir, 0755); err != nil {
+		return
+	}
 	return normalizeOnDiskPermissions(session.configDir)
 }
 
@@ -342,6 +393,103 @@ func normalizeVersion(version string) string {
 	return version
 }
 
+func normalizeMemory(memory int) int {
+	if memory < 1024 {
+		log.Printf("'%v' not a reasonable memory value. %s\n", memory,
+			"Using '1024', the default")
+		return 1024
+	}
+	return memory
+}
+
+// hostResources returns the host's physical memory, in MB, and CPU cores
+func hostResources() (memory, cpus int, err error) {
+	var (
+		memsize uint64
+		cores   uint32
+	)
+	if memsize, err = unix.SysctlUint64("hw.memsize"); err != nil {
+		return
+	}
+	if cores, err = unix.SysctlUint32("hw.ncpu"); err != nil {
+		return
+	}
+	return int(memsize / 1024 / 1024), int(cores), err
+}
+
+// admit checks if the host can accommodate the VM's vCPUs and RAM, on top of
+// what running VMs already hold and of the memory kept aside for the host
+// itself. when it can't, the overcommit policy (refuse, warn or allow)
+// decides what happens
+func (vm *VMInfo) admit(policy string, reserved int) (err error) {
+	var (
+		up                   []VMInfo
+		memory, cores        int
+		usedMemory, usedCpus int
+		overcommit           = func(what string) error {
+			switch policy {
+			case "allow":
+				return nil
+			case "warn":
+				log.Printf("overcommitting host resources: %s\n", what)
+				return nil
+			}
+			return fmt.Errorf("Aborting: %s. (see --overcommit)", what)
+		}
+	)
+
+	switch policy {
+	case "refuse", "warn", "allow":
+	default:
+		return fmt.Errorf("Aborting: '%s' isn't a valid overcommit policy "+
+			"(either 'refuse', 'warn' or 'allow')", policy)
+	}
+	if memory, cores, err = hostResources(); err != nil {
+		return
+	}
+	if vm.Cpus < 1 {
+		log.Printf("'%v' not a reasonable number of vCPUs. %s\n", vm.Cpus,
+			"Using '1', the default")
+		vm.Cpus = 1
+	} else if vm.Cpus > cores {
+		return fmt.Errorf("Aborting: asked for %v vCPUs but host only has "+
+			"%v cores", vm.Cpus, cores)
+	}
+	if up, err = allRunningInstances(); err != nil {
+		return
+	}
+	for _, d := range up {
+		usedMemory, usedCpus = usedMemory+d.Memory, usedCpus+d.Cpus
+	}
+	if free := memory - reserved - usedMemory; vm.Memory > free {
+		if err = overcommit(fmt.Sprintf("asked for %vMB of RAM but only "+
+			"%vMB are available (host has %vMB, %vMB reserved for itself "+
+			"and %vMB in use by running VMs)", vm.Memory, free, memory,
+			reserved, usedMemory)); err != nil {
+			return
+		}
+	}
+	if free := cores - usedCpus; vm.Cpus > free {
+		err = overcommit(fmt.Sprintf("asked for %v vCPUs but only %v "+
+			"are available (host has %v cores, %v in use by running VMs)",
+			vm.Cpus, free, cores, usedCpus))
+	}
+	return
+}
+
+// cloudConfigSum fingerprints a cloud-config, by its contents if it is a
+// local file or by its location otherwise
+func cloudConfigSum(location string) string {
+	if location == "" {
+		return ""
+	}
+	payload, err := ioutil.ReadFile(location)
+	if err != nil {
+		payload = []byte(location)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(payload))
+}
+
 func (vm *VMInfo) isActive() bool {
 	if p, _ := ps.FindProcess(vm.Pid); p == nil ||
 		!strings.HasSuffix(p.Executable(), "corectl") {
@@ -350,6 +498,19 @@ func (vm *VMInfo) isActive() bool {
 	return true
 }
 
+// setupScript returns the one shot steps that the VM's OEM runs at boot,
+// on behalf of the host
+func (vm *VMInfo) setupScript() string {
+	var steps = vm.networkSetup()
+	if devices := vm.volumesToGrow(true); len(devices) > 0 {
+		steps = append(steps, CoreOEMgrowFS)
+		for _, d := range devices {
+			steps = append(steps, "grow_fs "+d)
+		}
+	}
+	return strings.Join(steps, "\n") + "\n"
+}
+
 func (vm *VMInfo) metadataService() (endpoint string, err error) {
 	var (
 		free         net.Listener
@@ -416,6 +577,18 @@ func (vm *VMInfo) metadataService() (endpoint string, err error) {
 				w.Write([]byte(engine.homedir))
 			}
 		})
+	mux.HandleFunc(root+"/index",
+		func(w http.ResponseWriter, r *http.Request) {
+			if isAllowed(rIP(r.RemoteAddr), w) && vm.Index > 0 {
+				w.Write([]byte(strconv.Itoa(vm.Index)))
+			}
+		})
+	mux.HandleFunc(root+"/setup",
+		func(w http.ResponseWriter, r *http.Request) {
+			if isAllowed(rIP(r.RemoteAddr), w) {
+				w.Write([]byte(vm.setupScript()))
+			}
+		})
 	mux.HandleFunc(root+"/nfs",
 		func(w http.ResponseWriter, r *http.Request) {
 			if isAllowed(rIP(r.RemoteAddr), w) {
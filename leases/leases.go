@@ -0,0 +1,163 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package leases reads the DHCP leases that OS X's bootpd hands out to the
+// guests on the vmnet (shared) network
+package leases
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPath is where bootpd keeps its leases
+const DefaultPath = "/var/db/dhcpd_leases"
+
+// Lease is a single DHCP lease
+type Lease struct {
+	Name   string
+	IP     net.IP
+	MAC    net.HardwareAddr
+	Expiry time.Time
+}
+
+// Parse reads all the leases from r, which holds one block per lease, as in
+//
+//	{
+//		name=coreos
+//		ip_address=192.168.64.2
+//		hw_address=1,2:a:3b:4c:5d:6e
+//		identifier=1,2:a:3b:4c:5d:6e
+//		lease=0x56e2b5f3
+//	}
+//
+// with the lease's expiry as an hexadecimal UNIX timestamp
+func Parse(r io.Reader) (leases []Lease, err error) {
+	var (
+		l       *Lease
+		lineNum int
+		lines   = bufio.NewScanner(r)
+	)
+	for lines.Scan() {
+		lineNum++
+		line := strings.TrimSpace(lines.Text())
+		switch {
+		case line == "":
+		case line == "{":
+			if l != nil {
+				return nil, fmt.Errorf("line %v: lease block inside "+
+					"another one", lineNum)
+			}
+			l = &Lease{}
+		case line == "}":
+			if l == nil {
+				return nil, fmt.Errorf("line %v: unbalanced '}'", lineNum)
+			}
+			// partial entries are of no use to anyone
+			if l.IP != nil && l.MAC != nil {
+				leases = append(leases, *l)
+			}
+			l = nil
+		case l == nil:
+			return nil, fmt.Errorf("line %v: '%s' outside of a lease block",
+				lineNum, line)
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %v: '%s' isn't a key=value pair",
+					lineNum, line)
+			}
+			switch kv[0] {
+			case "name":
+				l.Name = kv[1]
+			case "ip_address":
+				l.IP = net.ParseIP(kv[1])
+			case "hw_address":
+				// prefixed by the hardware type (1, for ethernet)
+				if i := strings.Index(kv[1], ","); i != -1 {
+					l.MAC, _ = ParseMAC(kv[1][i+1:])
+				}
+			case "lease":
+				if t, e := strconv.ParseInt(kv[1], 0, 64); e == nil {
+					l.Expiry = time.Unix(t, 0)
+				}
+			}
+		}
+	}
+	if err = lines.Err(); err == nil && l != nil {
+		err = fmt.Errorf("truncated lease block at the end")
+	}
+	return
+}
+
+// ParseMAC parses MAC addresses the way bootpd writes them, which is with
+// each octet's leading zero stripped (as in 2:a:3b:4c:5d:6e)
+func ParseMAC(s string) (mac net.HardwareAddr, err error) {
+	for _, octet := range strings.Split(s, ":") {
+		var b uint64
+		if b, err = strconv.ParseUint(octet, 16, 8); err != nil {
+			return nil, fmt.Errorf("'%s' isn't a valid MAC address", s)
+		}
+		mac = append(mac, byte(b))
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("'%s' isn't a valid MAC address", s)
+	}
+	return
+}
+
+// Load reads all the leases in the given file
+func Load(path string) (leases []Lease, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Find returns the IP of the most recent, unexpired, lease that the given
+// file holds for the given MAC address
+func Find(path, mac string) (ip string, err error) {
+	var (
+		all   []Lease
+		hw    net.HardwareAddr
+		found *Lease
+		now   = time.Now()
+	)
+	if hw, err = ParseMAC(mac); err != nil {
+		return
+	}
+	if all, err = Load(path); err != nil {
+		return
+	}
+	for i, l := range all {
+		if bytes.Equal(l.MAC, hw) && l.Expiry.After(now) &&
+			(found == nil || l.Expiry.After(found.Expiry)) {
+			found = &all[i]
+		}
+	}
+	if found == nil {
+		return ip, fmt.Errorf("%s isn't in ANY active DHCP lease (!)", mac)
+	}
+	return found.IP.String(), nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package leases
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func block(name, ip, mac string, expiry time.Time) string {
+	return fmt.Sprintf("{\n\tname=%s\n\tip_address=%s\n\thw_address=1,%s\n"+
+		"\tidentifier=1,%s\n\tlease=%#x\n}\n", name, ip, mac, mac,
+		expiry.Unix())
+}
+
+func TestParseMAC(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+		bad      bool
+	}{
+		{in: "a:b:c:d:e:f", want: "0a:0b:0c:0d:0e:0f"},
+		{in: "2:a:3b:4c:5d:6e", want: "02:0a:3b:4c:5d:6e"},
+		{in: "02:0a:3b:4c:5d:6e", want: "02:0a:3b:4c:5d:6e"},
+		{in: "a:b:c:d:e", bad: true},
+		{in: "a:b:c:d:e:f:0", bad: true},
+		{in: "a:b:c:d:e:100", bad: true},
+		{in: "a:b:c:d:e:g", bad: true},
+		{in: "", bad: true},
+	} {
+		mac, err := ParseMAC(tt.in)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("ParseMAC(%q) = %v, want an error", tt.in, mac)
+			}
+			continue
+		}
+		if err != nil || mac.String() != tt.want {
+			t.Errorf("ParseMAC(%q) = %v, %v, want %v", tt.in, mac, err,
+				tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	var expiry = time.Unix(0x56e2b5f3, 0)
+	for _, tt := range []struct {
+		name, in string
+		want     []string
+		bad      bool
+	}{
+		{name: "empty", in: ""},
+		{name: "single block",
+			in:   block("coreos", "192.168.64.2", "2:a:3b:4c:5d:6e", expiry),
+			want: []string{"coreos 192.168.64.2 02:0a:3b:4c:5d:6e"}},
+		{name: "several blocks",
+			in: block("a", "192.168.64.2", "a:b:c:d:e:f", expiry) + "\n" +
+				block("b", "192.168.64.3", "1:2:3:4:5:6", expiry),
+			want: []string{"a 192.168.64.2 0a:0b:0c:0d:0e:0f",
+				"b 192.168.64.3 01:02:03:04:05:06"}},
+		{name: "partial block",
+			in: "{\n\tname=x\n\tip_address=192.168.64.9\n}\n" +
+				block("a", "192.168.64.2", "a:b:c:d:e:f", expiry),
+			want: []string{"a 192.168.64.2 0a:0b:0c:0d:0e:0f"}},
+		{name: "nested block", in: "{\n{\n}\n}\n", bad: true},
+		{name: "unbalanced", in: "}\n", bad: true},
+		{name: "outside block", in: "name=x\n", bad: true},
+		{name: "not key=value", in: "{\n\tname\n}\n", bad: true},
+		{name: "truncated", in: "{\n\tname=x\n", bad: true},
+	} {
+		leases, err := Parse(strings.NewReader(tt.in))
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, leases)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, l := range leases {
+			got = append(got, fmt.Sprintf("%s %s %s", l.Name, l.IP, l.MAC))
+			if !l.Expiry.Equal(expiry) {
+				t.Errorf("%s: %s expires at %v, want %v", tt.name, l.Name,
+					l.Expiry, expiry)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	var (
+		now     = time.Now()
+		expired = now.Add(-time.Hour)
+		active  = now.Add(time.Hour)
+	)
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name, leases, mac, want string
+		bad                     bool
+	}{
+		{name: "active",
+			leases: block("a", "192.168.64.2", "a:b:c:d:e:f", active),
+			mac:    "0a:0b:0c:0d:0e:0f", want: "192.168.64.2"},
+		{name: "zero-stripped query",
+			leases: block("a", "192.168.64.2", "a:b:c:d:e:f", active),
+			mac:    "a:b:c:d:e:f", want: "192.168.64.2"},
+		{name: "several blocks",
+			leases: block("a", "192.168.64.2", "1:2:3:4:5:6", active) +
+				block("b", "192.168.64.3", "a:b:c:d:e:f", active),
+			mac: "a:b:c:d:e:f", want: "192.168.64.3"},
+		{name: "expired",
+			leases: block("a", "192.168.64.2", "a:b:c:d:e:f", expired),
+			mac:    "a:b:c:d:e:f", bad: true},
+		{name: "expired and active",
+			leases: block("a", "192.168.64.2", "a:b:c:d:e:f", expired) +
+				block("a", "192.168.64.4", "a:b:c:d:e:f", active),
+			mac: "a:b:c:d:e:f", want: "192.168.64.4"},
+		{name: "most recent",
+			leases: block("a", "192.168.64.5", "a:b:c:d:e:f",
+				active.Add(time.Hour)) +
+				block("a", "192.168.64.4", "a:b:c:d:e:f", active),
+			mac: "a:b:c:d:e:f", want: "192.168.64.5"},
+		{name: "unknown MAC",
+			leases: block("a", "192.168.64.2", "a:b:c:d:e:f", active),
+			mac:    "1:2:3:4:5:6", bad: true},
+		{name: "invalid MAC",
+			leases: block("a", "192.168.64.2", "a:b:c:d:e:f", active),
+			mac:    "a:b:c", bad: true},
+	} {
+		path := filepath.Join(dir, "dhcpd_leases")
+		if err = ioutil.WriteFile(path, []byte(tt.leases),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+		ip, err := Find(path, tt.mac)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, ip)
+			}
+			continue
+		}
+		if err != nil || ip != tt.want {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, ip, err, tt.want)
+		}
+	}
+
+	if _, err = Find(filepath.Join(dir, "missing"),
+		"a:b:c:d:e:f"); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v, want a not exist error", err)
+	}
+}
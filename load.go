@@ -16,15 +16,15 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
+	"log"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -34,82 +34,367 @@ var (
 		Short: "Loads CoreOS instances defined in an instrumentation file.",
 		Long: "Loads CoreOS instances defined in an instrumentation file " +
 			"(either in TOML, JSON or YAML format).\n" + "VMs are always launched " +
-			"by alphabetical order relative to their names.",
+			"by alphabetical order relative to their names, after the " +
+			"ones\n(entries or VMs) listed in their 'depends_on', which " +
+			"have to be up, as per\ntheir 'wait_for' conditions, " +
+			"beforehand.\n" +
+			"Entries with a 'count' key are launched as that many replicas, " +
+			"named after their\n'name' template (e.g. \"node-%02d\"), which " +
+			"volume paths may also use. Each\nreplica's index is exported, " +
+			"as INDEX, in its /etc/environment.\n" +
+			"Profiles may 'include' other ones (paths relative to their own, " +
+			"as are the paths these\nhold), and entries may 'extends' another " +
+			"one, usually flagged as a 'template'\n(which isn't booted). " +
+			"${VAR} and ${VAR:-default} get replaced by the environment\n" +
+			"variable VAR's value, except in commented out lines.",
 		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
 			if len(args) != 1 {
 				return fmt.Errorf("Incorrect usage: " +
 					"This command requires one argument (a file path)")
 			}
 			engine.rawArgs.BindPFlags(cmd.Flags())
+			if engine.rawArgs.GetBool("plan") ||
+				engine.rawArgs.GetBool("dry-run") {
+				return
+			}
 			return engine.allowedToRun()
 		},
-		RunE:    loadCommand,
-		Example: `  corectl load profiles/demo.toml`,
+		RunE: loadCommand,
+		Example: `  corectl load profiles/demo.toml
+  corectl load --dry-run profiles/demo.toml // validates the profile
+  corectl load --plan profiles/demo.toml  // shows what --apply would do
+  corectl load --apply profiles/demo.toml // boots, halts or restarts VMs
+                                          // until they match the profile`,
 	}
 )
 
 func loadCommand(cmd *cobra.Command, args []string) (err error) {
 	var (
-		vmDefs  = make(map[string]*viper.Viper)
+		vmDefs  map[string]*viper.Viper
 		ordered []string
-		f       []byte
-		def     = args[0]
-		setup   = viper.New()
 	)
 
-	if f, err = ioutil.ReadFile(def); err != nil {
+	if vmDefs, ordered, err = loadProfile(args[0]); err != nil {
 		return
 	}
-
-	if strings.HasSuffix(def, ".toml") {
-		setup.SetConfigType("toml")
-	} else if strings.HasSuffix(def, ".json") {
-		setup.SetConfigType("json")
-	} else if strings.HasSuffix(def, ".yaml") ||
-		strings.HasSuffix(def, ".yml") {
-		setup.SetConfigType("yaml")
-	} else {
-		return fmt.Errorf("%s unable to guess format via suffix", def)
+	if engine.rawArgs.GetBool("dry-run") {
+		return rehearseProfile(args[0], vmDefs, ordered)
+	}
+	if engine.rawArgs.GetBool("plan") || engine.rawArgs.GetBool("apply") {
+		return reconcileProfile(args[0], vmDefs, ordered)
+	}
+	for _, level := range bootLevels(vmDefs, ordered) {
+		if err = bootLevel(level, vmDefs); err != nil {
+			return
+		}
 	}
+	return
+}
 
-	if err = setup.ReadConfig(bytes.NewBuffer(f)); err != nil {
-		return
+// bootLevel boots the given VMs, which share a dependency level, and then
+// waits for all of them to be ready, as the next level may depend on them
+func bootLevel(names []string, vmDefs map[string]*viper.Viper) (err error) {
+	var booted []*VMInfo
+
+	for _, name := range names {
+		fmt.Println("> booting", name)
+		engine.VMs = append(engine.VMs, vmContext{})
+		slot := len(engine.VMs) - 1
+		if err = engine.boot(slot, vmDefs[name]); err != nil {
+			return
+		}
+		booted = append(booted, engine.VMs[slot].vm)
 	}
+	for _, vm := range booted {
+		if err = vm.waitReady(); err != nil {
+			return
+		}
+	}
+	return
+}
 
-	for name, def := range setup.AllSettings() {
-		if reflect.ValueOf(def).Kind() == reflect.Map {
-			lf := pflag.NewFlagSet(name, 0)
-			runFlagsDefaults(lf)
-			vmDefs[name] = viper.New()
-			vmDefs[name].BindPFlags(lf)
+// rehearseProfile resolves and validates each VM that the given profile
+// defines, as it would happen at boot time, and shows the outcome without
+// booting anything
+func rehearseProfile(profile string, vmDefs map[string]*viper.Viper,
+	ordered []string) (err error) {
+	var (
+		failed int
+		// volumes and tap devices already claimed by previous entries
+		claimed = make(map[string]string)
+	)
 
-			for x, xx := range setup.AllSettings() {
-				if reflect.ValueOf(x).Kind() != reflect.Map {
-					vmDefs[name].Set(x, xx)
+	for _, name := range ordered {
+		var vm *VMInfo
+		fmt.Println("> resolving", name)
+		if vm, err = vmBootstrap(vmDefs[name], true); err == nil {
+			for _, d := range vm.Storage.HardDrives {
+				if other, taken := claimed[d.Path]; taken {
+					err = fmt.Errorf("%s already used as a volume by '%s'",
+						d.Path, other)
 				}
+				claimed[d.Path] = name
 			}
-			for x, xx := range def.(map[string]interface{}) {
-				vmDefs[name].Set(x, xx)
+			for _, e := range vm.Ethernet {
+				if other, taken := claimed[e.Path]; e.Type == Tap && taken {
+					err = fmt.Errorf("%s already used by '%s'", e.Path, other)
+				}
+				claimed[e.Path] = name
 			}
-			vmDefs[name].Set("name", name)
-			vmDefs[name].Set("detached", true)
 		}
+		if err != nil {
+			log.Printf("'%s' wouldn't boot: %v\n",
+				name, strings.TrimSpace(err.Error()))
+			failed++
+			continue
+		}
+		vm.ppResolved()
 	}
-	// (re)order alphabeticaly order to ensure cheap deterministic boot ordering
-	for name := range vmDefs {
-		ordered = append(ordered, name)
+	if failed > 0 {
+		return fmt.Errorf("%v out of %v VMs defined in %s wouldn't boot",
+			failed, len(ordered), profile)
 	}
-	sort.Strings(ordered)
-	for slot, name := range ordered {
-		fmt.Println("> booting", name)
-		engine.VMs = append(engine.VMs, vmContext{})
-		if err = engine.boot(slot, vmDefs[name]); err != nil {
+	return nil
+}
+
+// ppResolved shows the settings a VM would get, alongside the exact xhyve
+// invocation that would boot it
+func (vm *VMInfo) ppResolved() {
+	var endpoint = fmt.Sprintf("http://%v:<port>/%v", engine.address, vm.Name)
+
+	fmt.Printf("- %v, %v/%v (detached=%v)\n",
+		vm.Name, vm.Channel, vm.Version, vm.Detached)
+	fmt.Printf("  - %v vCPU(s), %v RAM\n", vm.Cpus, vm.Memory)
+	vm.ppKernel()
+	if mac := vm.MacAddress; mac != "" {
+		fmt.Printf("  - UUID: %v (MAC: %v)\n", vm.UUID, mac)
+	} else {
+		fmt.Printf("  - UUID: %v (MAC: derived at boot)\n", vm.UUID)
+	}
+	if vm.CloudConfig != "" {
+		fmt.Printf("  - cloud-config: %v (%v)\n", vm.CloudConfig, vm.CClocation)
+	}
+	vm.ppNetwork()
+	vm.Storage.pp(vm.Root)
+	if len(vm.readiness) > 0 {
+		fmt.Printf("  - up once met: %v\n", vm.readiness)
+	}
+
+	instr, kexec, cmdline := vm.hypervisorArgs(endpoint)
+	fmt.Printf("  - xhyve %s -f %s\"%s\"\n",
+		strings.Join(instr[1:], " "), kexec, cmdline)
+}
+
+// reconcileProfile compares what the given profile declares with what is
+// actually running, and unless just planning, (re)boots and halts VMs until
+// both match
+func reconcileProfile(profile string, vmDefs map[string]*viper.Viper,
+	ordered []string) (err error) {
+	var (
+		up                  []VMInfo
+		vm                  VMInfo
+		abs                 string
+		changes             []string
+		toHalt, toBoot      []string
+		running             = make(map[string]VMInfo)
+		plan                = engine.rawArgs.GetBool("plan")
+		missing, drifted    = make(map[string]bool), make(map[string]bool)
+		unchanged, orphaned []string
+	)
+
+	if abs, err = filepath.Abs(profile); err != nil {
+		return
+	}
+	if up, err = allRunningInstances(); err != nil {
+		return
+	}
+	for _, vm = range up {
+		running[vm.Name] = vm
+		if _, declared := vmDefs[vm.Name]; !declared && vm.Profile == abs {
+			orphaned = append(orphaned, vm.Name)
+		}
+	}
+	sort.Strings(orphaned)
+
+	for _, name := range ordered {
+		var ok bool
+		if vm, ok = running[name]; !ok {
+			missing[name] = true
+			fmt.Printf("+ %s (will be booted)\n", name)
+			continue
+		}
+		if vm.Profile != abs {
+			return fmt.Errorf("Aborting: '%s' is already running but wasn't "+
+				"loaded from '%s'", name, profile)
+		}
+		if changes, err = vm.drift(vmDefs[name]); err != nil {
+			return
+		}
+		if len(changes) > 0 {
+			drifted[name] = true
+			fmt.Printf("~ %s (will be restarted)\n", name)
+			for _, c := range changes {
+				fmt.Printf("    - %s\n", c)
+			}
+		} else {
+			unchanged = append(unchanged, name)
+		}
+	}
+	for _, name := range orphaned {
+		fmt.Printf("- %s (no longer declared, will be halted)\n", name)
+	}
+	for _, name := range unchanged {
+		fmt.Printf("= %s (up to date)\n", name)
+	}
+	if plan {
+		return
+	}
+
+	// halts happen in reverse boot order, and boots in the usual one
+	toHalt = append(toHalt, orphaned...)
+	for i := len(ordered) - 1; i >= 0; i-- {
+		if drifted[ordered[i]] {
+			toHalt = append(toHalt, ordered[i])
+		}
+	}
+	for _, name := range ordered {
+		if missing[name] || drifted[name] {
+			toBoot = append(toBoot, name)
+		}
+	}
+	for _, name := range toHalt {
+		fmt.Println("> halting", name)
+		if err = running[name].halt(); err != nil {
+			return
+		}
+	}
+	for _, level := range bootLevels(vmDefs, toBoot) {
+		if err = bootLevel(level, vmDefs); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// drift lists the differences between the effective settings of a running VM
+// and the ones it would get if booted from the given (profile) settings
+func (vm *VMInfo) drift(args *viper.Viper) (changes []string, err error) {
+	var (
+		abs              string
+		channel, version = normalizeChannelName(args.GetString("channel")),
+			normalizeVersion(args.GetString("version"))
+		memory     = normalizeMemory(args.GetInt("memory"))
+		root       = args.GetString("root")
+		want, have []string
+		ccSum      = cloudConfigSum(args.GetString("cloud_config"))
+	)
+
+	if boot := args.GetString("boot"); boot != vm.Boot {
+		changes = append(changes,
+			fmt.Sprintf("boot: %v -> %v", vm.Boot, boot))
+	} else if boot == PXE {
+		// VMs booting off their root volume update themselves
+		if version, _, err = resolveVersion(channel, version,
+			args.GetBool("local")); err != nil {
+			return
+		}
+		if channel != vm.Channel || version != vm.Version {
+			changes = append(changes, fmt.Sprintf("image: %s/%s -> %s/%s",
+				vm.Channel, vm.Version, channel, version))
+		}
+	}
+	if cpus := args.GetInt("cpus"); cpus != vm.Cpus {
+		changes = append(changes,
+			fmt.Sprintf("cpus: %v -> %v", vm.Cpus, cpus))
+	}
+	if memory != vm.Memory {
+		changes = append(changes,
+			fmt.Sprintf("memory: %v -> %v", vm.Memory, memory))
+	}
+
+	if root != "" {
+		if root, err = diskSource(root); err != nil {
 			return
 		}
+		want = append(want, "/:"+root)
+	}
+	for _, v := range pSlice(args.GetStringSlice("volume")) {
+		if v != "" {
+			if abs, err = diskSource(v); err != nil {
+				return
+			}
+			want = append(want, abs)
+		}
+	}
+	for slot, v := range vm.Storage.HardDrives {
+		source := v.Path
+		if v.Snapshot != "" {
+			source = v.Snapshot
+		}
+		if i, _ := strconv.Atoi(slot); i == vm.Root {
+			have = append(have, "/:"+source)
+		} else {
+			have = append(have, source)
+		}
+	}
+	sort.Strings(want)
+	sort.Strings(have)
+	if !reflect.DeepEqual(want, have) && len(want)+len(have) > 0 {
+		changes = append(changes, fmt.Sprintf("volumes: %v -> %v",
+			have, want))
+	}
+
+	wanted := new(VMInfo)
+	if err = wanted.validateNetworks(args.GetStringSlice("net"),
+		args.GetString("tap")); err != nil {
+		return
+	}
+	want, have = nil, nil
+	for _, e := range wanted.Ethernet {
+		want = append(want, e.String())
+	}
+	for _, e := range vm.Ethernet {
+		have = append(have, e.String())
+	}
+	if !reflect.DeepEqual(want, have) {
+		changes = append(changes, fmt.Sprintf("network: %v -> %v",
+			have, want))
+	}
+
+	for _, k := range []struct{ what, want, have string }{
+		{"kernel", args.GetString("kernel"), vm.Kernel},
+		{"initrd", args.GetString("initrd"), vm.Initrd},
+	} {
+		if k.want != "" {
+			if k.want, err = filepath.Abs(k.want); err != nil {
+				return
+			}
+		}
+		if k.want != k.have {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q",
+				k.what, k.have, k.want))
+		}
+	}
+	if kargs := strings.Join(args.GetStringSlice("kernel_arg"), " "); kargs !=
+		strings.Join(vm.KernelArgs, " ") {
+		changes = append(changes, fmt.Sprintf("kernel args: %q -> %q",
+			strings.Join(vm.KernelArgs, " "), kargs))
+	}
+
+	if ccSum != vm.CCsum {
+		changes = append(changes, "cloud-config: contents changed")
 	}
 	return
 }
 
 func init() {
+	loadFCmd.Flags().Bool("apply", false, "reconciles the running VMs with "+
+		"the profile, booting missing ones, halting the ones no longer "+
+		"declared and restarting the ones whose settings changed")
+	loadFCmd.Flags().Bool("plan", false,
+		"just shows what --apply would do, without acting")
+	loadFCmd.Flags().Bool("dry-run", false, "resolves and validates each "+
+		"VM's settings, showing them and how xhyve would be invoked, "+
+		"without booting anything")
 	RootCmd.AddCommand(loadFCmd)
 }
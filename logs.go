@@ -0,0 +1,272 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// each VM's console log is rotated once it grows past consoleLogSize,
+	// with up to consoleLogKeep older ones kept around
+	consoleLogSize = 4 * 1024 * 1024
+	consoleLogKeep = 2
+	consoleStamp   = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var (
+	logsCmd = &cobra.Command{
+		Use:   "logs VMid",
+		Short: "Shows the serial console output of a running CoreOS instance",
+		Long: "Shows the serial console output of a running CoreOS " +
+			"instance, since it booted, regardless of it having been " +
+			"started in the background or not.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			engine.rawArgs.BindPFlags(cmd.Flags())
+			if len(args) != 1 {
+				return fmt.Errorf("Incorrect usage. " +
+					"This command requires exactly one argument (a VM's " +
+					"name or UUID).")
+			}
+			return
+		},
+		RunE: logsCommand,
+		Example: `  corectl logs VMid             // dumps all that VMid logged so far
+  corectl logs -f --since 5m VMid // the last 5 minutes, then follows`,
+	}
+)
+
+// consoleLog is a size capped, rotated, log of a VM's serial console with
+// each line prefixed by when it got logged
+type consoleLog struct {
+	path      string
+	f         *os.File
+	size      int64
+	lineStart bool
+}
+
+func newConsoleLog(path string) (l *consoleLog, err error) {
+	var fi os.FileInfo
+
+	l = &consoleLog{path: path, lineStart: true}
+	if l.f, err = os.OpenFile(path,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	if fi, err = l.f.Stat(); err != nil {
+		return
+	}
+	l.size = fi.Size()
+	return l, normalizeOnDiskPermissions(path)
+}
+
+func (l *consoleLog) rotate() (err error) {
+	l.f.Close()
+	for i := consoleLogKeep; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%v", l.path, i-1),
+			fmt.Sprintf("%s.%v", l.path, i))
+	}
+	if err = os.Rename(l.path, l.path+".1"); err != nil {
+		return
+	}
+	if l.f, err = os.OpenFile(l.path,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	l.size = 0
+	return normalizeOnDiskPermissions(l.path)
+}
+
+// Write never fails, as the console must keep flowing regardless of the
+// log, which is best effort only
+func (l *consoleLog) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+
+	// lines are never split across files
+	if l.size >= consoleLogSize && l.lineStart {
+		if err := l.rotate(); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, c := range p {
+		if c == '\r' {
+			continue
+		}
+		if l.lineStart {
+			buf.WriteString(time.Now().Format(consoleStamp) + " ")
+			l.lineStart = false
+		}
+		buf.WriteByte(c)
+		l.lineStart = c == '\n'
+	}
+	if n, err := l.f.Write(buf.Bytes()); err == nil {
+		l.size += int64(n)
+	}
+	return len(p), nil
+}
+
+// relayConsole captures the VM's serial console, as soon as xhyve brings up
+// its pty, into a log in its run directory, while serving it to whoever
+// attaches to it (via 'corectl console' or a foreground 'corectl run')
+func relayConsole(rundir string, ptys chan string) {
+	var (
+		pty     *os.File
+		console io.Writer
+		err     error
+	)
+
+	if pty, err = os.OpenFile(<-ptys, os.O_RDWR, 0); err != nil {
+		log.Println(err)
+		return
+	}
+	// plain passthrough, with neither echoes nor line buffering
+	if _, err = terminal.MakeRaw(int(pty.Fd())); err != nil {
+		log.Println(err)
+	}
+	if console, err =
+		newConsoleLog(filepath.Join(rundir, "console.log")); err != nil {
+		log.Println(err)
+		console = ioutil.Discard
+	}
+	if hub, e := serveConsole(filepath.Join(rundir, "console.sock"),
+		pty); e != nil {
+		log.Println(e)
+	} else {
+		console = io.MultiWriter(console, hub)
+	}
+	io.Copy(console, pty)
+}
+
+func logsCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		vm       VMInfo
+		since    time.Time
+		f        *os.File
+		logs     []string
+		show     bool
+		midLine  bool
+		follow   = engine.rawArgs.GetBool("follow")
+		stamps   = engine.rawArgs.GetBool("timestamps")
+		printOut = func(r *bufio.Reader) (e error) {
+			var line string
+			for {
+				if line, e = r.ReadString('\n'); line != "" {
+					if !midLine {
+						// only line starts carry a timestamp
+						stamp := strings.SplitN(line, " ", 2)
+						when, _ := time.Parse(consoleStamp, stamp[0])
+						if show = !when.Before(since); show && !stamps &&
+							len(stamp) == 2 {
+							line = stamp[1]
+						}
+					}
+					if show {
+						fmt.Print(line)
+					}
+					midLine = !strings.HasSuffix(line, "\n")
+				}
+				if e != nil {
+					return
+				}
+			}
+		}
+	)
+
+	if vm, err = vmInfo(args[0]); err != nil {
+		return
+	}
+	if since, err = parseSince(engine.rawArgs.GetString("since")); err != nil {
+		return
+	}
+	path := filepath.Join(engine.runDir, vm.UUID, "console.log")
+	// oldest first
+	for i := consoleLogKeep; i > 0; i-- {
+		logs = append(logs, fmt.Sprintf("%s.%v", path, i))
+	}
+	for _, l := range append(logs, path) {
+		if f, err = os.Open(l); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		if err = printOut(bufio.NewReader(f)); err != io.EOF {
+			f.Close()
+			return
+		}
+		err = nil
+		if l != path || !follow {
+			f.Close()
+			f = nil
+		}
+	}
+	if !follow {
+		return
+	}
+	if f == nil {
+		return fmt.Errorf("'%s' didn't log anything yet", vm.Name)
+	}
+	defer func() { f.Close() }()
+
+	r := bufio.NewReader(f)
+	for {
+		if err = printOut(r); err != io.EOF {
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+		// once rotated, drains what's left of the previous file and moves
+		// on to the new one
+		if current, e := os.Stat(path); e == nil {
+			if was, e := f.Stat(); e == nil && !os.SameFile(current, was) {
+				printOut(r)
+				f.Close()
+				if f, err = os.Open(path); err != nil {
+					return
+				}
+				r = bufio.NewReader(f)
+			}
+		}
+		if !vm.isActive() {
+			// drain what's left
+			printOut(r)
+			return nil
+		}
+	}
+}
+
+func init() {
+	logsCmd.Flags().BoolP("follow", "f", false,
+		"keeps following the console output, as it gets logged")
+	logsCmd.Flags().String("since", "",
+		"only shows what got logged since the given time (RFC 3339) or "+
+			"for the given period (such as 10m or 2h)")
+	logsCmd.Flags().BoolP("timestamps", "t", false,
+		"shows when each line got logged")
+	RootCmd.AddCommand(logsCmd)
+}
@@ -50,8 +50,18 @@ var (
 	Version, BuildDate string
 )
 
+// exitError is an error that a command wants to end with a specific exit
+// status, meant for scripts to rely upon, instead of the usual one
+type exitError struct {
+	error
+	code int
+}
+
 func main() {
 	if err := RootCmd.Execute(); err != nil {
+		if e, ok := err.(exitError); ok {
+			os.Exit(e.code)
+		}
 		os.Exit(-1)
 	}
 }
@@ -0,0 +1,237 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseNetSpec parses a network interface spec, as given to --net: either
+// nat or tap:DEV, optionally followed by a static address (ip=IP/PREFIX), a
+// gateway (gw=IP) and DNS servers (dns=IP, which may be repeated)
+func parseNetSpec(spec string) (nic NetworkInterface, err error) {
+	fields := strings.Split(spec, ",")
+	switch kind := fields[0]; {
+	case kind == "nat":
+		nic.Type = Raw
+	case strings.HasPrefix(kind, "tap:"):
+		nic.Type = Tap
+		if nic.Path, err = tapDevice(kind[len("tap:"):]); err != nil {
+			return
+		}
+	default:
+		return nic, fmt.Errorf("Aborting: '%s' isn't a valid --net spec "+
+			"(it must start with either nat or tap:DEV)", spec)
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nic, fmt.Errorf("Aborting: '%s' in --net %s isn't a "+
+				"KEY=VALUE setting", f, spec)
+		}
+		switch kv[0] {
+		case "ip":
+			var ip net.IP
+			if ip, _, err = net.ParseCIDR(kv[1]); err != nil ||
+				ip.To4() == nil {
+				return nic, fmt.Errorf("Aborting: '%s' in --net %s isn't "+
+					"an IPv4 address with its prefix length (as "+
+					"192.168.64.100/24)", kv[1], spec)
+			}
+			nic.Address = kv[1]
+		case "gw", "dns":
+			if ip := net.ParseIP(kv[1]); ip == nil || ip.To4() == nil {
+				return nic, fmt.Errorf("Aborting: '%s' in --net %s isn't "+
+					"an IPv4 address", kv[1], spec)
+			}
+			if kv[0] == "gw" {
+				nic.Gateway = kv[1]
+			} else {
+				nic.DNS = append(nic.DNS, kv[1])
+			}
+		default:
+			return nic, fmt.Errorf("Aborting: unknown setting '%s' in "+
+				"--net %s (valid ones are ip, gw and dns)", kv[0], spec)
+		}
+	}
+	if nic.Gateway != "" && nic.Address == "" {
+		return nic, fmt.Errorf("Aborting: --net %s sets a gateway without "+
+			"a static address (ip=)", spec)
+	}
+	return
+}
+
+// tapDevice checks that the given tap device, by name or path, exists,
+// returning its name
+func tapDevice(tap string) (dev string, err error) {
+	if !strings.Contains(tap, "/") {
+		tap = filepath.Join("/dev", tap)
+	}
+	if dir := filepath.Dir(tap); !strings.HasPrefix(dir, "/dev") {
+		return "", fmt.Errorf("Aborting: '%v' not a valid tap device...", tap)
+	}
+	if dev = filepath.Base(tap); !strings.HasPrefix(dev, "tap") {
+		return "", fmt.Errorf("Aborting: '%v' not a valid tap device...", tap)
+	}
+	_, err = os.Stat(tap)
+	return
+}
+
+// validateNetworks sets up the VM's network interfaces, out of its --net
+// specs and of its (older) --tap. the first interface is always a NAT one,
+// as it's the one the VM reaches the host through, and the only one as
+// vmnet identifies interfaces by the VM's UUID (and so would hand a second
+// one eth0's MAC and lease)
+func (vm *VMInfo) validateNetworks(specs []string, tap string) (err error) {
+	var nic NetworkInterface
+	if tap != "" {
+		specs = append(specs, "tap:"+tap)
+	}
+	vm.Ethernet = nil
+	for _, s := range specs {
+		if s == "" {
+			continue
+		}
+		if nic, err = parseNetSpec(s); err != nil {
+			return
+		}
+		if len(vm.Ethernet) == 0 && nic.Type != Raw {
+			vm.Ethernet = append(vm.Ethernet, NetworkInterface{Type: Raw})
+		} else if len(vm.Ethernet) > 0 && nic.Type == Raw {
+			return fmt.Errorf("Aborting: '%s' would be a second nat "+
+				"interface, while VMs can only have one (the first)", s)
+		}
+		for _, e := range vm.Ethernet {
+			if nic.Type == Tap && e.Type == Tap && e.Path == nic.Path {
+				return fmt.Errorf("Aborting: %s given more than once",
+					nic.Path)
+			}
+		}
+		vm.Ethernet = append(vm.Ethernet, nic)
+	}
+	if len(vm.Ethernet) == 0 {
+		vm.Ethernet = append(vm.Ethernet, NetworkInterface{Type: Raw})
+	}
+	return
+}
+
+// String returns the interface's --net spec
+func (nic NetworkInterface) String() string {
+	spec := "nat"
+	if nic.Type == Tap {
+		spec = "tap:" + nic.Path
+	}
+	if nic.Address != "" {
+		spec += ",ip=" + nic.Address
+	}
+	if nic.Gateway != "" {
+		spec += ",gw=" + nic.Gateway
+	}
+	for _, d := range nic.DNS {
+		spec += ",dns=" + d
+	}
+	return spec
+}
+
+// privateInterface is the interface that COREOS_PRIVATE_IPV4 gets its
+// address from, in the guest: the first tap one, if any
+func (vm *VMInfo) privateInterface() int {
+	for i, e := range vm.Ethernet {
+		if e.Type == Tap {
+			return i
+		}
+	}
+	return 0
+}
+
+// networkSetup returns the steps that, in the guest, bring its network
+// interfaces to the static settings they were given, as systemd-networkd
+// units. the ones left alone just get an address over DHCP, as usual
+func (vm *VMInfo) networkSetup() (steps []string) {
+	var reconfigured bool
+	steps = append(steps,
+		fmt.Sprintf("PRIVATE_IFACE=eth%d", vm.privateInterface()))
+	for i, e := range vm.Ethernet {
+		if e.Address == "" && len(e.DNS) == 0 {
+			continue
+		}
+		unit := []string{"[Match]", fmt.Sprintf("Name=eth%d", i), "",
+			"[Network]"}
+		if e.Address == "" {
+			unit = append(unit, "DHCP=yes")
+		} else {
+			unit = append(unit, "Address="+e.Address)
+		}
+		if e.Gateway != "" {
+			unit = append(unit, "Gateway="+e.Gateway)
+		}
+		for _, d := range e.DNS {
+			unit = append(unit, "DNS="+d)
+		}
+		if !reconfigured {
+			steps = append(steps, "mkdir -p /run/systemd/network")
+		}
+		steps = append(steps,
+			fmt.Sprintf("cat > /run/systemd/network/50-corectl-eth%d.network"+
+				" <<'EOF'\n%s\nEOF", i, strings.Join(unit, "\n")))
+		if e.Address != "" {
+			// dropping whatever DHCP handed out meanwhile
+			steps = append(steps, fmt.Sprintf("ip -4 addr flush dev eth%d", i))
+		}
+		reconfigured = true
+	}
+	if reconfigured {
+		steps = append(steps, "systemctl restart systemd-networkd")
+	}
+	return
+}
+
+// ppNetwork shows the VM's network interfaces
+func (vm *VMInfo) ppNetwork() {
+	fmt.Println("  - Network Interfaces:")
+	for i, e := range vm.Ethernet {
+		var what string
+		switch {
+		case i == 0:
+			what = "public interface"
+		case e.Type == Tap:
+			what = fmt.Sprintf("private interface/%v on host", e.Path)
+		default:
+			what = "nat interface"
+		}
+		if i == vm.privateInterface() && i > 0 {
+			what += ", COREOS_PRIVATE_IPV4"
+		}
+		fmt.Printf("    - eth%d (%s)", i, what)
+		switch {
+		case e.Address != "":
+			fmt.Printf(" %v", e.Address)
+		case i == 0 && vm.PublicIP != "":
+			fmt.Printf(" %v", vm.PublicIP)
+		}
+		if e.Gateway != "" {
+			fmt.Printf(" via %v", e.Gateway)
+		}
+		if len(e.DNS) > 0 {
+			fmt.Printf(" (DNS %v)", strings.Join(e.DNS, ", "))
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yeonsh/go-ps"
+	"golang.org/x/crypto/ssh"
+)
+
+var portForwardCmd = &cobra.Command{
+	Use: "port-forward VMid [HOST_ADDRESS:]HOST_PORT:GUEST_PORT|" +
+		"unix:HOST_PATH:GUEST_PATH...",
+	Aliases: []string{"forward"},
+	Short: "Forwards host ports and unix sockets to a running CoreOS " +
+		"instance",
+	Long: "Forwards host ports and unix sockets to a running CoreOS " +
+		"instance, relaying them through ssh. Host ports listen on " +
+		"localhost unless told otherwise.\n" +
+		"Forwarders run in the foreground, until interrupted, or in the " +
+		"background (-d), where 'ps' lists them until they get stopped " +
+		"(--stop) or the VM halts.",
+	PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+		engine.rawArgs.BindPFlags(cmd.Flags())
+		if len(args) < 1 ||
+			(len(args) < 2 && !engine.rawArgs.GetBool("stop")) {
+			return fmt.Errorf("Incorrect usage: see 'corectl " +
+				cmd.Use + "'")
+		}
+		return
+	},
+	RunE: portForwardCommand,
+	Example: `  corectl port-forward VMid 8080:80
+  corectl port-forward -d VMid unix:/tmp/docker.sock:/var/run/docker.sock
+  corectl port-forward --stop VMid                // stops all of VMid's
+  corectl port-forward --stop VMid 8080:80        // just that one`,
+}
+
+// portForward is a host endpoint, relayed to a guest one
+type portForward struct {
+	spec, network, local, remote string
+}
+
+func parsePortForward(spec string) (f portForward, err error) {
+	f.spec = spec
+	if strings.HasPrefix(spec, "unix:") {
+		paths := strings.SplitN(spec[len("unix:"):], ":", 2)
+		if len(paths) != 2 || paths[0] == "" ||
+			!strings.HasPrefix(paths[1], "/") {
+			return f, fmt.Errorf("Aborting: '%s' isn't a valid unix socket "+
+				"forward (unix:HOST_PATH:GUEST_PATH, the latter absolute)",
+				spec)
+		}
+		f.network, f.remote = "unix", paths[1]
+		f.local, err = filepath.Abs(paths[0])
+		return
+	}
+	var (
+		fields = strings.Split(spec, ":")
+		host   = "127.0.0.1"
+	)
+	switch len(fields) {
+	case 3:
+		host, fields = fields[0], fields[1:]
+	case 2:
+	default:
+		return f, fmt.Errorf("Aborting: '%s' isn't a valid port forward "+
+			"([HOST_ADDRESS:]HOST_PORT:GUEST_PORT)", spec)
+	}
+	for _, p := range fields {
+		if n, e := strconv.Atoi(p); e != nil || n < 1 || n > 65535 {
+			return f, fmt.Errorf("Aborting: '%s' in '%s' isn't a valid "+
+				"port", p, spec)
+		}
+	}
+	f.network = "tcp"
+	f.local = net.JoinHostPort(host, fields[0])
+	f.remote = net.JoinHostPort("127.0.0.1", fields[1])
+	return
+}
+
+// dial opens, through the VM's ssh connection, the guest's end of the
+// forward
+func (f portForward) dial(conn *ssh.Client) (io.ReadWriteCloser, error) {
+	if f.network == "tcp" {
+		return conn.Dial("tcp", f.remote)
+	}
+	// as OpenSSH's ssh -L does for unix sockets
+	ch, reqs, err := conn.OpenChannel("direct-streamlocal@openssh.com",
+		ssh.Marshal(&struct {
+			SocketPath string
+			Reserved0  string
+			Reserved1  uint32
+		}{f.remote, "", 0}))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+func (f portForward) listen() (net.Listener, error) {
+	if f.network == "unix" {
+		// leftovers of forwarders that didn't get to clean up
+		if fi, err := os.Lstat(f.local); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			if _, err = net.Dial("unix", f.local); err != nil {
+				os.Remove(f.local)
+			}
+		}
+	}
+	return net.Listen(f.network, f.local)
+}
+
+// relay copies data both ways until both sides are done, half closing each
+// as the other one is
+func relay(a, b io.ReadWriteCloser) {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	done := make(chan bool, 2)
+	copyAndClose := func(dst, src io.ReadWriteCloser) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- true
+	}
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// forwardersDir is where the VM's background forwarders keep their state,
+// one file per forwarder, named after its PID
+func (vm *VMInfo) forwardersDir() string {
+	return filepath.Join(engine.runDir, vm.UUID, "forwarders")
+}
+
+// forwarders returns the VM's background forwarders still around
+func (vm *VMInfo) forwarders() (fwds []Forwarder) {
+	files, _ := ioutil.ReadDir(vm.forwardersDir())
+	for _, fi := range files {
+		var fwd Forwarder
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(vm.forwardersDir(),
+			fi.Name()))
+		if err != nil || json.Unmarshal(buf, &fwd) != nil {
+			continue
+		}
+		if p, _ := ps.FindProcess(fwd.Pid); p == nil ||
+			!strings.HasSuffix(p.Executable(), "corectl") {
+			continue
+		}
+		fwds = append(fwds, fwd)
+	}
+	return
+}
+
+// forward relays the given forwards, until interrupted, or until the VM
+// halts, calling up once all are listening
+func (vm VMInfo) forward(forwards []portForward,
+	up func() error) (err error) {
+	var (
+		conn   *ssh.Client
+		halted = make(chan error, 1)
+		stop   = make(chan os.Signal, 1)
+	)
+	if conn, err = vm.sshDial(5 * time.Second); err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for _, f := range forwards {
+		var l net.Listener
+		if l, err = f.listen(); err != nil {
+			return
+		}
+		defer l.Close()
+		go func(f portForward, l net.Listener) {
+			for {
+				local, e := l.Accept()
+				if e != nil {
+					return
+				}
+				go func() {
+					remote, e := f.dial(conn)
+					if e != nil {
+						log.Printf("%s: %v\n", f.spec, e)
+						local.Close()
+						return
+					}
+					relay(local, remote)
+				}()
+			}
+		}(f, l)
+	}
+	if err = up(); err != nil {
+		return
+	}
+
+	go func() { halted <- conn.Wait() }()
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-halted:
+			return fmt.Errorf("lost the ssh connection to '%s'", vm.Name)
+		case <-time.After(5 * time.Second):
+			if _, e := runningConfig(vm.UUID); e != nil {
+				return fmt.Errorf("'%s' is gone", vm.Name)
+			}
+		}
+	}
+}
+
+func portForwardCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		vm       VMInfo
+		forwards []portForward
+	)
+	if vm, err = vmInfo(args[0]); err != nil {
+		return
+	}
+	for _, s := range args[1:] {
+		var f portForward
+		if f, err = parsePortForward(s); err != nil {
+			return
+		}
+		forwards = append(forwards, f)
+	}
+	cmd.SilenceUsage = true
+
+	if engine.rawArgs.GetBool("stop") {
+		return vm.stopForwarders(forwards)
+	}
+
+	switch {
+	case engine.rawArgs.GetBool("managed"):
+		// a background forwarder, spawned by 'port-forward -d'
+		state := filepath.Join(vm.forwardersDir(),
+			fmt.Sprintf("%d.json", os.Getpid()))
+		defer os.Remove(state)
+		return vm.forward(forwards, func() error {
+			buf, _ := json.MarshalIndent(Forwarder{Pid: os.Getpid(),
+				Specs: args[1:], StartedAt: time.Now()}, "", "    ")
+			return writeFileAtomic(state, buf, 0644)
+		})
+	case engine.rawArgs.GetBool("detached"):
+		return vm.spawnForwarder(args[1:])
+	default:
+		return vm.forward(forwards, func() error {
+			log.Printf("forwarding %s to '%s' (ctrl-c to stop)\n",
+				strings.Join(args[1:], ", "), vm.Name)
+			return nil
+		})
+	}
+}
+
+// spawnForwarder starts a background forwarder, waiting until it's up (or
+// failed to)
+func (vm *VMInfo) spawnForwarder(specs []string) (err error) {
+	var (
+		logf   *os.File
+		exited = make(chan error, 1)
+		logs   = filepath.Join(vm.forwardersDir(), "forwarders.log")
+	)
+	if err = os.MkdirAll(vm.forwardersDir(), 0755); err != nil {
+		return
+	}
+	if logf, err = os.OpenFile(logs,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	defer logf.Close()
+
+	c := exec.Command(os.Args[0],
+		append([]string{"port-forward", "--managed", vm.UUID}, specs...)...)
+	c.Stdout, c.Stderr = logf, logf
+	// outliving us, and the terminal we're in
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = c.Start(); err != nil {
+		return
+	}
+	go func() { exited <- c.Wait() }()
+
+	state := filepath.Join(vm.forwardersDir(),
+		fmt.Sprintf("%d.json", c.Process.Pid))
+	for timeout := time.After(30 * time.Second); ; {
+		select {
+		case <-exited:
+			return fmt.Errorf("Aborting: the forwarder failed to start "+
+				"(see %s)", logs)
+		case <-timeout:
+			c.Process.Kill()
+			return fmt.Errorf("Aborting: the forwarder didn't start "+
+				"after 30s (see %s)", logs)
+		case <-time.After(100 * time.Millisecond):
+			if _, e := os.Stat(state); e == nil {
+				log.Printf("forwarding %s to '%s' in background, "+
+					"with PID %v\n", strings.Join(specs, ", "), vm.Name,
+					c.Process.Pid)
+				return
+			}
+		}
+	}
+}
+
+// stopForwarders stops the VM's background forwarders, either all of them
+// or those listening where any of the given forwards would
+func (vm *VMInfo) stopForwarders(forwards []portForward) (err error) {
+	var stopped int
+	for _, fwd := range vm.forwarders() {
+		selected := len(forwards) == 0
+		for _, s := range fwd.Specs {
+			running, _ := parsePortForward(s)
+			for _, f := range forwards {
+				selected = selected || (f.network == running.network &&
+					f.local == running.local)
+			}
+		}
+		if !selected {
+			continue
+		}
+		if p, e := os.FindProcess(fwd.Pid); e == nil {
+			if e = p.Signal(syscall.SIGTERM); e == nil {
+				log.Printf("stopped forwarding %s to '%s' (PID %v)\n",
+					strings.Join(fwd.Specs, ", "), vm.Name, fwd.Pid)
+				stopped++
+			}
+		}
+	}
+	if stopped == 0 {
+		return fmt.Errorf("no matching forwarders of '%s' found", vm.Name)
+	}
+	return
+}
+
+func init() {
+	portForwardCmd.Flags().BoolP("detached", "d", false,
+		"forwards in the background")
+	portForwardCmd.Flags().Bool("stop", false,
+		"stops the VM's background forwarders (all, or just the ones given)")
+	// how background forwarders get spawned
+	portForwardCmd.Flags().Bool("managed", false, "")
+	portForwardCmd.Flags().MarkHidden("managed")
+	RootCmd.AddCommand(portForwardCmd)
+}
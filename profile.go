@@ -0,0 +1,448 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var (
+	// settings that only make sense inside profiles
+	profileOnlySettings = map[string]bool{
+		"count": true, "depends_on": true, "ephemeral": true, "extends": true,
+		"template": true,
+	}
+	// ${VAR} or ${VAR:-default}
+	envRefs = regexp.MustCompile(
+		`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+)
+
+// loadProfile parses the given instrumentation file returning the per VM
+// settings, indexed by name, and the order by which they are to be booted
+func loadProfile(profile string) (vmDefs map[string]*viper.Viper,
+	ordered []string, err error) {
+	var (
+		abs      string
+		settings map[string]interface{}
+		entries  = make(map[string]map[string]interface{})
+		defaults = make(map[string]interface{})
+		// what each (non template) entry depends on, and the entry that
+		// each VM comes from
+		deps   = make(map[string][]string)
+		owners = make(map[string]string)
+		levels = make(map[string]int)
+	)
+	vmDefs = make(map[string]*viper.Viper)
+
+	if abs, err = filepath.Abs(profile); err != nil {
+		return
+	}
+	if settings, err = readProfile(abs, nil); err != nil {
+		return
+	}
+	for name, def := range settings {
+		if reflect.ValueOf(def).Kind() == reflect.Map {
+			entries[name] = cast.ToStringMap(def)
+		} else {
+			defaults[name] = def
+		}
+	}
+
+	for name := range entries {
+		var (
+			replicas map[string]map[string]interface{}
+			merged   map[string]interface{}
+			lf       = pflag.NewFlagSet(name, 0)
+		)
+		if cast.ToBool(entries[name]["template"]) {
+			continue
+		}
+		if merged, err = resolveExtends(name, entries, nil); err != nil {
+			return
+		}
+		settings = mergeSettings(defaults, merged)
+
+		runFlagsDefaults(lf)
+		for x := range settings {
+			if lf.Lookup(x) == nil && !profileOnlySettings[x] {
+				log.Printf("'%s' isn't a known setting (in '%s'), "+
+					"ignoring it\n", x, name)
+			}
+		}
+		if replicas, err = expandReplicas(name, settings); err != nil {
+			return
+		}
+		deps[name] = []string{}
+		for _, d := range pSlice(cast.ToStringSlice(settings["depends_on"])) {
+			// as entries' names, once parsed, are all lowercase
+			if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+				deps[name] = append(deps[name], d)
+			}
+		}
+		for replica, settings := range replicas {
+			if _, clash := vmDefs[replica]; clash {
+				err = fmt.Errorf("Aborting: '%s' is defined more than "+
+					"once in %s", replica, profile)
+				return
+			}
+			lf := pflag.NewFlagSet(replica, 0)
+			runFlagsDefaults(lf)
+			vmDefs[replica] = viper.New()
+			vmDefs[replica].BindPFlags(lf)
+			for x, xx := range settings {
+				vmDefs[replica].Set(x, xx)
+			}
+			vmDefs[replica].Set("name", replica)
+			vmDefs[replica].Set("detached", true)
+			vmDefs[replica].Set("profile", abs)
+			// keyed as depends_on targets are, in lowercase
+			owners[strings.ToLower(replica)] = name
+		}
+	}
+	var (
+		names []string
+		depth int
+	)
+	for name := range vmDefs {
+		var level int
+		if level, err = dependencyLevel(owners[strings.ToLower(name)], deps,
+			owners, levels, nil); err != nil {
+			return
+		}
+		vmDefs[name].Set("level", level)
+		if level > depth {
+			depth = level
+		}
+		names = append(names, name)
+	}
+	// (re)order alphabeticaly order to ensure cheap deterministic boot
+	// ordering, with VMs always booted after the ones they depend on
+	sort.Strings(names)
+	for level := 0; level <= depth; level++ {
+		for _, name := range names {
+			if vmDefs[name].GetInt("level") == level {
+				ordered = append(ordered, name)
+			}
+		}
+	}
+	return
+}
+
+// dependencyLevel returns how deep in the dependency graph a profile entry
+// is, with the ones that don't depend on any other being at level 0. each
+// dependency is either another entry or a VM (such as a replica). 'chain'
+// holds the entries depending on it, in order to catch loops
+func dependencyLevel(entry string, deps map[string][]string,
+	owners map[string]string, levels map[string]int,
+	chain []string) (level int, err error) {
+	var ok bool
+
+	if level, ok = levels[entry]; ok {
+		return
+	}
+	for _, c := range chain {
+		if c == entry {
+			return level, fmt.Errorf("Aborting: '%s' depends on itself "+
+				"(via %s)", entry, strings.Join(chain, " -> "))
+		}
+	}
+	for _, d := range deps[entry] {
+		var (
+			l     int
+			owner = d
+		)
+		if _, ok = deps[d]; !ok {
+			if owner, ok = owners[d]; !ok {
+				return level, fmt.Errorf("Aborting: '%s' depends on '%s', "+
+					"which isn't a VM defined in the profile", entry, d)
+			}
+		}
+		if l, err = dependencyLevel(owner, deps, owners, levels,
+			append(chain, entry)); err != nil {
+			return
+		}
+		if l+1 > level {
+			level = l + 1
+		}
+	}
+	levels[entry] = level
+	return
+}
+
+// bootLevels splits the given VMs, in boot order, by dependency level, as
+// all of a level's VMs have to be ready before the next level gets booted
+func bootLevels(vmDefs map[string]*viper.Viper,
+	ordered []string) (levels [][]string) {
+	for i, name := range ordered {
+		if i == 0 || vmDefs[name].GetInt("level") !=
+			vmDefs[ordered[i-1]].GetInt("level") {
+			levels = append(levels, nil)
+		}
+		levels[len(levels)-1] = append(levels[len(levels)-1], name)
+	}
+	return
+}
+
+// readProfile parses a single instrumentation file, after interpolating any
+// environment variables it references, and (recursively) merges on top of
+// the ones it includes. 'chain' holds the files that are including it, in
+// order to catch include loops
+func readProfile(profile string,
+	chain []string) (settings map[string]interface{}, err error) {
+	var (
+		f        []byte
+		setup    = viper.New()
+		included = make(map[string]interface{})
+	)
+
+	for _, c := range chain {
+		if c == profile {
+			return settings, fmt.Errorf("Aborting: %s includes itself "+
+				"(via %s)", profile, strings.Join(chain, " -> "))
+		}
+	}
+	if f, err = ioutil.ReadFile(profile); err != nil {
+		return
+	}
+	if f, err = interpolateEnv(f); err != nil {
+		return settings, fmt.Errorf("%s: %v", profile, err)
+	}
+
+	if strings.HasSuffix(profile, ".toml") {
+		setup.SetConfigType("toml")
+	} else if strings.HasSuffix(profile, ".json") {
+		setup.SetConfigType("json")
+	} else if strings.HasSuffix(profile, ".yaml") ||
+		strings.HasSuffix(profile, ".yml") {
+		setup.SetConfigType("yaml")
+	} else {
+		return settings,
+			fmt.Errorf("%s unable to guess format via suffix", profile)
+	}
+
+	if err = setup.ReadConfig(bytes.NewBuffer(f)); err != nil {
+		return
+	}
+	settings = setup.AllSettings()
+
+	// included files are relative to the one including them, and so are
+	// the paths they hold
+	for _, inc := range pSlice(cast.ToStringSlice(settings["include"])) {
+		var s map[string]interface{}
+		if inc == "" {
+			continue
+		}
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(profile), inc)
+		}
+		if s, err = readProfile(inc, append(chain, profile)); err != nil {
+			return
+		}
+		anchorPaths(s, filepath.Dir(inc))
+		included = mergeSettings(included, s)
+	}
+	delete(settings, "include")
+	return mergeSettings(included, settings), err
+}
+
+// interpolateEnv replaces ${VAR} and ${VAR:-default} references by the
+// value VAR has in the environment (or by 'default' if VAR is unset or
+// empty). commented out lines are left alone
+func interpolateEnv(raw []byte) (out []byte, err error) {
+	var lines = bytes.SplitAfter(raw, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		lines[i] = envRefs.ReplaceAllFunc(line, func(ref []byte) []byte {
+			m := envRefs.FindSubmatch(ref)
+			if v := os.Getenv(string(m[1])); v != "" {
+				return []byte(v)
+			}
+			if len(m[2]) == 0 {
+				if _, set := os.LookupEnv(string(m[1])); !set && err == nil {
+					err = fmt.Errorf("'%s' references an undefined "+
+						"environment variable, and has no default", ref)
+				}
+			}
+			return m[3]
+		})
+	}
+	return bytes.Join(lines, nil), err
+}
+
+// anchorPaths makes the relative paths an included profile holds, either at
+// its top level or within its entries, relative to that profile instead of
+// to the working directory. volume names, snapshots and URLs are left alone
+func anchorPaths(settings map[string]interface{}, dir string) {
+	var anchor = func(p string, volume bool) string {
+		if p = strings.TrimSpace(p); p == "" || filepath.IsAbs(p) ||
+			strings.Contains(p, "://") {
+			return p
+		}
+		if _, _, snapshot := snapshotRef(p); volume &&
+			(snapshot || isVolumeName(p)) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for k, v := range settings {
+		if reflect.ValueOf(v).Kind() == reflect.Map {
+			entry := cast.ToStringMap(v)
+			anchorPaths(entry, dir)
+			settings[k] = entry
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "cloud_config", "cdrom", "kernel", "initrd":
+			settings[k] = anchor(cast.ToString(v), false)
+		case "root":
+			settings[k] = anchor(cast.ToString(v), true)
+		case "volume", "ephemeral":
+			var anchored []string
+			for _, p := range pSlice(cast.ToStringSlice(v)) {
+				anchored = append(anchored, anchor(p, true))
+			}
+			settings[k] = anchored
+		}
+	}
+}
+
+// resolveExtends returns the settings of a profile entry once merged on top
+// of the ones of the entry (usually a template) it extends, if any. 'chain'
+// holds the entries extending it, in order to catch loops
+func resolveExtends(name string, entries map[string]map[string]interface{},
+	chain []string) (settings map[string]interface{}, err error) {
+	var (
+		base   map[string]interface{}
+		parent = cast.ToString(entries[name]["extends"])
+	)
+
+	for _, c := range chain {
+		if c == name {
+			return settings, fmt.Errorf("Aborting: '%s' extends itself "+
+				"(via %s)", name, strings.Join(chain, " -> "))
+		}
+	}
+	if parent != "" {
+		if _, ok := entries[parent]; !ok {
+			return settings, fmt.Errorf("Aborting: '%s' extends '%s', "+
+				"which isn't defined", name, parent)
+		}
+		if base, err = resolveExtends(parent, entries,
+			append(chain, name)); err != nil {
+			return
+		}
+	}
+	settings = mergeSettings(base, entries[name])
+	delete(settings, "extends")
+	delete(settings, "template")
+	return
+}
+
+// mergeSettings returns a copy of 'base' overlaid with 'overlay', with
+// nested tables being merged key by key instead of replaced
+func mergeSettings(base,
+	overlay map[string]interface{}) (merged map[string]interface{}) {
+	merged = make(map[string]interface{})
+	for k, v := range base {
+		merged[strings.ToLower(k)] = v
+	}
+	for k, v := range overlay {
+		k = strings.ToLower(k)
+		if reflect.ValueOf(v).Kind() == reflect.Map &&
+			reflect.ValueOf(merged[k]).Kind() == reflect.Map {
+			v = mergeSettings(cast.ToStringMap(merged[k]), cast.ToStringMap(v))
+		}
+		merged[k] = v
+	}
+	return
+}
+
+// expandReplicas turns a profile entry with a 'count' key into that many
+// entries, named after the 'name' template (which defaults to "<entry>-%d"),
+// each with its own index and with its volumes' paths derived from it when
+// these are also templates
+func expandReplicas(entry string, settings map[string]interface{}) (
+	replicas map[string]map[string]interface{}, err error) {
+	var (
+		count   = cast.ToInt(settings["count"])
+		pattern = cast.ToString(settings["name"])
+	)
+	replicas = make(map[string]map[string]interface{})
+
+	if _, ok := settings["count"]; !ok {
+		replicas[entry] = settings
+		return
+	}
+	if count < 1 {
+		return replicas, fmt.Errorf("Aborting: '%s' has a 'count' of %v, "+
+			"which isn't a positive integer", entry, settings["count"])
+	}
+	if pattern == "" {
+		pattern = entry + "-%d"
+	}
+	if !strings.Contains(pattern, "%") {
+		return replicas, fmt.Errorf("Aborting: '%s' needs a name template, "+
+			"such as '%s', to set its replicas apart", entry, entry+"-%02d")
+	}
+	for i := 1; i <= count; i++ {
+		replica := make(map[string]interface{})
+		for k, v := range settings {
+			replica[k] = v
+		}
+		delete(replica, "count")
+		replica["index"] = i
+		for _, k := range []string{"root", "volume", "ephemeral"} {
+			if _, ok := settings[k]; !ok {
+				continue
+			}
+			var derived []string
+			for _, v := range pSlice(cast.ToStringSlice(settings[k])) {
+				if strings.Contains(v, "%") {
+					v = fmt.Sprintf(v, i)
+				} else if _, _, snapshot := snapshotRef(v); v != "" &&
+					!snapshot && k != "ephemeral" && count > 1 {
+					return replicas, fmt.Errorf("Aborting: '%s' would be "+
+						"shared by all replicas of '%s'. Use a template, "+
+						"such as 'path/to/%s.img', instead", v, entry,
+						entry+"-%02d")
+				}
+				derived = append(derived, v)
+			}
+			if k == "root" {
+				replica[k] = strings.Join(derived, "")
+			} else {
+				replica[k] = derived
+			}
+		}
+		replicas[fmt.Sprintf(pattern, i)] = replica
+	}
+	return
+}
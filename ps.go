@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -51,6 +52,17 @@ var (
 		},
 		RunE: queryCommand,
 	}
+	errDead = fmt.Errorf("dead")
+	// vmMigrations[n] brings a VM's state file from schema version n to n+1
+	vmMigrations = []func(map[string]interface{}) error{
+		// unversioned files, as written until then, share v1's layout
+		func(map[string]interface{}) error { return nil },
+		// v2 tells how VMs boot, which until then was always PXE
+		func(raw map[string]interface{}) error {
+			raw["Boot"] = PXE
+			return nil
+		},
+	}
 )
 
 func queryCommand(cmd *cobra.Command, args []string) (err error) {
@@ -75,6 +87,9 @@ func queryCommand(cmd *cobra.Command, args []string) (err error) {
 	if running, err = allRunningInstances(); err != nil {
 		return
 	}
+	for i := range running {
+		running[i].Forwarders = running[i].forwarders()
+	}
 	if len(args) == 0 {
 		if engine.rawArgs.GetBool("json") {
 			if pp, err = json.MarshalIndent(running, "", "    "); err == nil {
@@ -102,6 +117,7 @@ func queryCommand(cmd *cobra.Command, args []string) (err error) {
 		if vm, err = vmInfo(target); err != nil {
 			return
 		}
+		vm.Forwarders = vm.forwarders()
 		selected = append(selected, vm)
 	}
 	if engine.rawArgs.GetBool("json") {
@@ -124,12 +140,20 @@ func psCommand(cmd *cobra.Command, args []string) (err error) {
 	var (
 		pp      []byte
 		running []VMInfo
+		broken  map[string]error
 	)
 
-	if running, err = allRunningInstances(); err != nil {
+	if running, broken, err = runningInstances(); err != nil {
 		return
 	}
+	for i := range running {
+		running[i].Forwarders = running[i].forwarders()
+	}
 	if engine.rawArgs.GetBool("json") {
+		// kept off stdout, not to get in the way of whoever parses it
+		for uuid, e := range broken {
+			log.Printf("unable to read the state of VM %v: %v\n", uuid, e)
+		}
 		if pp, err = json.MarshalIndent(running, "", "    "); err == nil {
 			fmt.Println(string(pp))
 		}
@@ -139,23 +163,50 @@ func psCommand(cmd *cobra.Command, args []string) (err error) {
 	for _, vm := range running {
 		totalC, totalM = totalC+vm.Cpus, totalM+vm.Memory
 	}
-	log.Printf("found %v running VMs, summing %v vCPUs and %vMB in use.\n",
-		totalV, totalC, totalM)
+	if hostM, hostC, e := hostResources(); e == nil {
+		log.Printf("found %v running VMs, summing %v vCPUs and %vMB in use "+
+			"(host has %v cores and %vMB).\n", totalV, totalC, totalM,
+			hostC, hostM)
+	} else {
+		log.Printf("found %v running VMs, summing %v vCPUs and %vMB in use.\n",
+			totalV, totalC, totalM)
+	}
 	for _, vm := range running {
 		vm.pp(engine.rawArgs.GetBool("all"))
 	}
+	for uuid, e := range broken {
+		fmt.Printf("- %v, unreadable state: %v\n  - see %v\n", uuid, e,
+			filepath.Join(engine.runDir, uuid, "config"))
+	}
 	return
 }
 
 func allRunningInstances() (alive []VMInfo, err error) {
+	alive, _, err = runningInstances()
+	return
+}
+
+// runningInstances is as allRunningInstances but also returns, by UUID, the
+// errors of the state files that couldn't be made sense of
+func runningInstances() (alive []VMInfo, broken map[string]error, err error) {
 	var ls []os.FileInfo
 
+	broken = make(map[string]error)
 	if ls, err = ioutil.ReadDir(engine.runDir); err != nil {
 		return
 	}
 	for _, d := range ls {
-		if r, e := runningConfig(d.Name()); e == nil {
+		if !d.IsDir() {
+			continue
+		}
+		r, e := runningConfig(d.Name())
+		switch {
+		case e == nil:
 			alive = append(alive, r)
+		// VMs that are gone, or being claimed just now
+		case e == errDead, os.IsNotExist(e):
+		default:
+			broken[d.Name()] = e
 		}
 	}
 	return
@@ -166,26 +217,49 @@ func (vm *VMInfo) pp(extended bool) {
 		vm.Name, vm.Channel, vm.Version, vm.Pid, vm.Detached,
 		time.Now().Sub(vm.CreatedAt))
 	fmt.Printf("  - %v vCPU(s), %v RAM\n", vm.Cpus, vm.Memory)
+	vm.ppKernel()
 	if vm.CloudConfig != "" {
 		fmt.Printf("  - cloud-config: %v\n", vm.CloudConfig)
 	}
-	fmt.Println("  - Network Interfaces:")
-	fmt.Printf("    - eth0 (public interface) %v\n", vm.PublicIP)
-	if len(vm.Ethernet) > 1 {
-		fmt.Printf("    - eth1 (private interface/%v on host)\n", vm.Ethernet[1].Path)
-	}
+	vm.ppNetwork()
 	vm.Storage.pp(vm.Root)
+	if len(vm.Forwarders) > 0 {
+		fmt.Println("  - Port forwards:")
+		for _, f := range vm.Forwarders {
+			fmt.Printf("    - %v (PID %v)\n", strings.Join(f.Specs, ", "), f.Pid)
+		}
+	}
 	if extended {
 		fmt.Printf("  - UUID: %v\n", vm.UUID)
 		if vm.SSHkey != "" {
 			fmt.Printf("  - ssh key: %v\n", vm.SSHkey)
 		}
+		if vm.Profile != "" {
+			fmt.Printf("  - loaded from: %v\n", vm.Profile)
+		}
 		if vm.Extra != "" {
 			fmt.Printf("  - custom args to xhyve: %v\n", vm.Extra)
 		}
 	}
 }
 
+// ppKernel shows where the VM's kernel and initrd come from, when not from
+// its channel, and how its kernel command line got changed
+func (vm *VMInfo) ppKernel() {
+	if vm.Boot == Disk {
+		fmt.Printf("  - boots off its root volume (%v)\n", vm.BootSlot)
+	}
+	if vm.Kernel != "" {
+		fmt.Printf("  - kernel: %v (custom)\n", vm.Kernel)
+	}
+	if vm.Initrd != "" {
+		fmt.Printf("  - initrd: %v (custom)\n", vm.Initrd)
+	}
+	if len(vm.KernelArgs) > 0 {
+		fmt.Printf("  - kernel args: %v\n", strings.Join(vm.KernelArgs, " "))
+	}
+}
+
 func (volumes *storageAssets) pp(root int) {
 	if len(volumes.CDDrives)+len(volumes.HardDrives) > 0 {
 		fmt.Println("  - Volumes:")
@@ -195,10 +269,14 @@ func (volumes *storageAssets) pp(root int) {
 		for a, b := range volumes.HardDrives {
 			i, _ := strconv.Atoi(a)
 			if i != root {
-				fmt.Printf("    - /dev/vd%v (%s)\n", string(i+'a'), b.Path)
+				fmt.Printf("    - /dev/vd%v (%s)", string(i+'a'), b.Path)
 			} else {
-				fmt.Printf("    - /,/dev/vd%v (%s)\n", string(i+'a'), b.Path)
+				fmt.Printf("    - /,/dev/vd%v (%s)", string(i+'a'), b.Path)
 			}
+			if b.Snapshot != "" {
+				fmt.Printf(", throwaway clone of %s", b.Snapshot)
+			}
+			fmt.Println()
 		}
 	}
 }
@@ -210,9 +288,44 @@ func runningConfig(uuid string) (vm VMInfo, err error) {
 			uuid, "/config")); err != nil {
 		return
 	}
-	json.Unmarshal(buf, &vm)
+	if vm, err = decodeVMState(buf); err != nil {
+		return
+	}
 	if !vm.isActive() {
-		return vm, fmt.Errorf("dead")
+		return vm, errDead
+	}
+	return
+}
+
+// decodeVMState parses a VM's state file, bringing older layouts up to date
+func decodeVMState(buf []byte) (vm VMInfo, err error) {
+	var (
+		raw     map[string]interface{}
+		version int
+	)
+	if err = json.Unmarshal(buf, &raw); err != nil {
+		return vm, fmt.Errorf("corrupt state file (%v)", err)
+	}
+	if v, ok := raw["SchemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > vmSchemaVersion {
+		return vm, fmt.Errorf("state file written by a newer corectl "+
+			"(schema version %v, this one only knows up to %v)",
+			version, vmSchemaVersion)
+	}
+	for ; version < vmSchemaVersion; version++ {
+		if err = vmMigrations[version](raw); err != nil {
+			return vm, fmt.Errorf("unable to migrate state file from "+
+				"schema version %v (%v)", version, err)
+		}
+		raw["SchemaVersion"] = version + 1
+	}
+	if buf, err = json.Marshal(raw); err == nil {
+		err = json.Unmarshal(buf, &vm)
+	}
+	if err != nil {
+		return vm, fmt.Errorf("corrupt state file (%v)", err)
 	}
 	return
 }
@@ -108,15 +108,32 @@ func findLatestUpstream(channel string) (releaseInfo map[string]string, err erro
 
 func lookupImage(channel, version string,
 	override, preferLocal bool) (a, b string, err error) {
+	var isLocal bool
+
+	if version, isLocal, err =
+		resolveVersion(channel, version, preferLocal); err != nil {
+		return channel, version, err
+	}
+	if isLocal && !override {
+		log.Printf("%s/%s already available on your system\n", channel, version)
+		return channel, version, err
+	}
+	return localize(channel, version)
+}
+
+// resolveVersion figures out the actual version that the given one (which
+// may be 'latest') stands for, and if it is already available locally,
+// without fetching anything
+func resolveVersion(channel, version string,
+	preferLocal bool) (v string, isLocal bool, err error) {
 	var (
-		isLocal     bool
 		ll          map[string]semver.Versions
 		l           semver.Versions
 		releaseInfo map[string]string
 	)
 
 	if ll, err = localImages(); err != nil {
-		return channel, version, err
+		return version, isLocal, err
 	}
 	l = ll[channel]
 	if version == "latest" {
@@ -128,8 +145,9 @@ func lookupImage(channel, version string,
 				if len(l) == 0 {
 					err = fmt.Errorf("offline and not a single locally image"+
 						"available for '%s' channel", channel)
-					return channel, version, err
+					return version, isLocal, err
 				}
+				err = nil
 				version = l[l.Len()-1].String()
 			} else {
 				version = releaseInfo["COREOS_VERSION"]
@@ -143,11 +161,7 @@ func lookupImage(channel, version string,
 			break
 		}
 	}
-	if isLocal && !override {
-		log.Printf("%s/%s already available on your system\n", channel, version)
-		return channel, version, err
-	}
-	return localize(channel, version)
+	return version, isLocal, err
 }
 
 func localize(channel, version string) (a string, b string, err error) {
@@ -171,71 +185,83 @@ func localize(channel, version string) (a string, b string, err error) {
 	for fn, location := range files {
 		// OEMify
 		if strings.HasSuffix(fn, "cpio.gz") {
-			var (
-				i, temp *os.File
-				r       *image.Reader
-				w       *image.Writer
-			)
-
-			if i, err = os.Open(location); err != nil {
+			if err = oemify(location, location, version); err != nil {
 				return
 			}
-			defer i.Close()
+		}
+		if err = os.Rename(location,
+			fmt.Sprintf("%s/%s", destination, fn)); err != nil {
+			return channel, version, err
+		}
+	}
+	if err = normalizeOnDiskPermissions(destination); err == nil {
+		log.Printf("%s/%s ready\n", channel, version)
+	}
+	return channel, version, err
+}
 
-			if r, err = image.NewReader(i); err != nil {
-				return
-			}
-			defer r.Close()
+// oemify writes to dst a copy of the given (PXE) initrd with corectl's OEM
+// bits injected, so that the VMs booting it get set up on behalf of the host
+func oemify(src, dst, version string) (err error) {
+	var (
+		i, temp *os.File
+		r       *image.Reader
+		w       *image.Writer
+	)
 
-			if temp, err = ioutil.TempFile(engine.tmpDir, "coreos"); err != nil {
-				return
-			}
-			defer temp.Close()
+	if i, err = os.Open(src); err != nil {
+		return
+	}
+	defer i.Close()
 
-			if w, err = image.NewWriter(temp); err != nil {
-				return
-			}
+	if r, err = image.NewReader(i); err != nil {
+		return
+	}
+	defer r.Close()
 
-			for _, d := range []string{"usr", "usr/share", "usr/share/oem",
-				"usr/share/oem/bin"} {
-				if err = w.WriteDir(d, 0755); err != nil {
-					return
-				}
-			}
+	if temp, err = ioutil.TempFile(filepath.Dir(dst), "coreos"); err != nil {
+		return
+	}
+	defer func() {
+		temp.Close()
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}()
 
-			if err = w.WriteToFile(bytes.NewBufferString(CoreOEMsetupBootstrap),
-				"usr/share/oem/cloud-config.yml", 0644); err != nil {
-				return
-			}
+	if w, err = image.NewWriter(temp); err != nil {
+		return
+	}
 
-			if err = w.WriteToFile(bytes.NewBufferString(
-				strings.Replace(CoreOEMsetup, "@@version@@", version, -1)),
-				"usr/share/oem/xhyve.yml", 0644); err != nil {
-				return
-			}
+	for _, d := range []string{"usr", "usr/share", "usr/share/oem",
+		"usr/share/oem/bin"} {
+		if err = w.WriteDir(d, 0755); err != nil {
+			return
+		}
+	}
 
-			if err = w.WriteToFile(bytes.NewBufferString(CoreOEMsetupEnv),
-				"usr/share/oem/bin/coreos-setup-environment",
-				0755); err != nil {
-				return
-			}
-			defer w.Close()
+	if err = w.WriteToFile(bytes.NewBufferString(CoreOEMsetupBootstrap),
+		"usr/share/oem/cloud-config.yml", 0644); err != nil {
+		return
+	}
 
-			if err = image.Copy(w, r); err != nil {
-				return
-			}
-			if err = os.Rename(temp.Name(), location); err != nil {
-				return
-			}
+	if err = w.WriteToFile(bytes.NewBufferString(
+		strings.Replace(CoreOEMsetup, "@@version@@", version, -1)),
+		"usr/share/oem/xhyve.yml", 0644); err != nil {
+		return
+	}
 
-		}
-		if err = os.Rename(location,
-			fmt.Sprintf("%s/%s", destination, fn)); err != nil {
-			return channel, version, err
-		}
+	if err = w.WriteToFile(bytes.NewBufferString(CoreOEMsetupEnv),
+		"usr/share/oem/bin/coreos-setup-environment",
+		0755); err != nil {
+		return
 	}
-	if err = normalizeOnDiskPermissions(destination); err == nil {
-		log.Printf("%s/%s ready\n", channel, version)
+
+	if err = image.Copy(w, r); err != nil {
+		return
 	}
-	return channel, version, err
+	if err = w.Close(); err != nil {
+		return
+	}
+	return os.Rename(temp.Name(), dst)
 }
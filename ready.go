@@ -0,0 +1,171 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// how long each readiness condition gets to be met, unless told otherwise
+const defaultReadyTimeout = 60 * time.Second
+
+// readyCheck is a condition that a VM started in the background has to meet,
+// once it got an IP, before being considered up, such as sshd answering
+// ("ssh"), a port being open ("tcp:2375"), a systemd unit being active
+// ("unit:docker.service") or an HTTP endpoint answering without errors
+// ("http:/health" or "http:8080/health"). each may carry its own timeout, as
+// in "unit:docker.service@2m"
+type readyCheck struct {
+	spec, kind, arg string
+	timeout         time.Duration
+}
+
+func parseReadyChecks(specs []string) (checks []readyCheck, err error) {
+	for _, spec := range specs {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		var (
+			c       = readyCheck{spec: spec, timeout: defaultReadyTimeout}
+			cond    = spec
+			invalid = fmt.Errorf("Aborting: '%s' isn't a valid condition "+
+				"(ssh, tcp:PORT, unit:NAME or http:[PORT]/PATH, "+
+				"optionally followed by @TIMEOUT)", spec)
+		)
+		if i := strings.LastIndex(spec, "@"); i != -1 {
+			if c.timeout, err = time.ParseDuration(spec[i+1:]); err != nil ||
+				c.timeout <= 0 {
+				return nil, invalid
+			}
+			cond = spec[:i]
+		}
+		parts := strings.SplitN(cond, ":", 2)
+		if c.kind = parts[0]; len(parts) == 2 {
+			c.arg = parts[1]
+		}
+		switch c.kind {
+		case "ssh":
+			if c.arg != "" {
+				return nil, invalid
+			}
+		case "tcp":
+			if port, e := strconv.Atoi(c.arg); e != nil ||
+				port < 1 || port > 65535 {
+				return nil, invalid
+			}
+		case "unit":
+			if c.arg == "" || strings.ContainsAny(c.arg, " \t'\";&|$`") {
+				return nil, invalid
+			}
+		case "http":
+			if !strings.HasPrefix(c.arg, "/") {
+				port := strings.SplitN(c.arg, "/", 2)[0]
+				if p, e := strconv.Atoi(port); e != nil || p < 1 ||
+					p > 65535 {
+					return nil, invalid
+				}
+			}
+		default:
+			return nil, invalid
+		}
+		checks = append(checks, c)
+	}
+	return
+}
+
+func (c readyCheck) String() string { return c.spec }
+
+// check tells whether the condition is met, right now
+func (c readyCheck) check(vm *VMInfo) (err error) {
+	switch c.kind {
+	case "ssh", "unit":
+		var (
+			conn    *ssh.Client
+			session *ssh.Session
+		)
+		if conn, err = vm.sshDial(0); err != nil {
+			return
+		}
+		defer conn.Close()
+		if c.kind == "ssh" {
+			return
+		}
+		if session, err = conn.NewSession(); err != nil {
+			return
+		}
+		defer session.Close()
+		if session.Run("systemctl is-active --quiet "+c.arg) != nil {
+			return fmt.Errorf("%s isn't active", c.arg)
+		}
+	case "tcp":
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp",
+			net.JoinHostPort(vm.PublicIP, c.arg), 2*time.Second); err != nil {
+			return
+		}
+		conn.Close()
+	case "http":
+		var (
+			resp   *http.Response
+			url    = "http://" + vm.PublicIP + c.arg
+			client = &http.Client{Timeout: 5 * time.Second}
+		)
+		if !strings.HasPrefix(c.arg, "/") {
+			url = "http://" + vm.PublicIP + ":" + c.arg
+		}
+		if resp, err = client.Get(url); err != nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s answered with %s", url, resp.Status)
+		}
+	}
+	return
+}
+
+// waitReady blocks until all of the VM's readiness conditions are met, in
+// turn, or until one of them times out
+func (vm *VMInfo) waitReady() (err error) {
+	if len(vm.readiness) == 0 {
+		return
+	}
+	for _, c := range vm.readiness {
+		log.Printf("waiting for '%s' (%s), up to %v\n", vm.Name, c, c.timeout)
+		for deadline := time.Now().Add(c.timeout); ; {
+			if err = c.check(vm); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				vm.event(EventFailed, fmt.Sprintf("%s not met: %v", c, err))
+				return fmt.Errorf("Aborting: '%s' didn't meet '%s' within "+
+					"%v (%v)", vm.Name, c, c.timeout, err)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	vm.event(EventReady, fmt.Sprintf("%v", vm.readiness))
+	log.Printf("'%s' is ready\n", vm.Name)
+	return
+}
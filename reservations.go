@@ -0,0 +1,212 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	reservationsCmd = &cobra.Command{
+		Use:   "reservations",
+		Short: "Lists the UUIDs reserved for each VM name",
+		Long: "Lists the UUIDs reserved for each VM name.\nA VM booted " +
+			"with a name, and no --uuid, keeps the UUID it got the first " +
+			"time, and so its MAC address and, as far as the host's DHCP " +
+			"server goes, its IP, until its reservation gets released.",
+		PreRunE: defaultPreRunE,
+		RunE:    reservationsCommand,
+	}
+	reservationsReleaseCmd = &cobra.Command{
+		Use:   "release NAME [NAME...]",
+		Short: "Releases the reservations of the given VM names",
+		Long: "Releases the reservations of the given VM names, which " +
+			"will get a new UUID, MAC and IP the next time they get booted.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if len(args) < 1 {
+				return fmt.Errorf("Incorrect usage: " +
+					"see 'corectl reservations " + cmd.Use + "'")
+			}
+			engine.rawArgs.BindPFlags(cmd.Flags())
+			return
+		},
+		RunE: reservationsReleaseCommand,
+	}
+)
+
+func reservationsPath() string {
+	return filepath.Join(engine.configDir, "reservations.json")
+}
+
+func readReservations() (r map[string]Reservation, err error) {
+	var buf []byte
+
+	r = make(map[string]Reservation)
+	if buf, err = ioutil.ReadFile(reservationsPath()); os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(buf, &r); err != nil {
+		err = fmt.Errorf("corrupt %s (%v)", reservationsPath(), err)
+	}
+	return
+}
+
+// updateReservations applies the given changes to the reservations, under a
+// lock so that concurrent boots don't step over each other's
+func updateReservations(change func(map[string]Reservation) error) (err error) {
+	var (
+		lock *os.File
+		r    map[string]Reservation
+		buf  []byte
+	)
+	if lock, err = os.OpenFile(filepath.Join(engine.configDir,
+		".reservations.lock"), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return
+	}
+	if r, err = readReservations(); err != nil {
+		return
+	}
+	if err = change(r); err != nil {
+		return
+	}
+	if buf, err = json.MarshalIndent(r, "", "    "); err != nil {
+		return
+	}
+	if err = writeFileAtomic(reservationsPath(), buf, 0644); err != nil {
+		return
+	}
+	return normalizeOnDiskPermissions(reservationsPath())
+}
+
+// reservedUUID returns the UUID reserved for the given VM name, if any
+func reservedUUID(name string) (uuid string) {
+	r, err := readReservations()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return r[name].UUID
+}
+
+// reserve keeps the VM's UUID, and what derives from it, for its name,
+// unless it got booted with an explicit UUID other than the one reserved.
+// failing to do so is never fatal
+func (vm *VMInfo) reserve() {
+	if vm.Name == vm.UUID {
+		return
+	}
+	if err := updateReservations(func(r map[string]Reservation) error {
+		had, ok := r[vm.Name]
+		if ok && had.UUID != vm.UUID {
+			return nil
+		}
+		// until the VM gets its IP, the last known one is still the best
+		// guess there is (and the one to keep if it never boots)
+		ip := vm.PublicIP
+		if ip == "" {
+			ip = had.PublicIP
+		}
+		r[vm.Name] = Reservation{Name: vm.Name, UUID: vm.UUID,
+			MacAddress: vm.MacAddress, PublicIP: ip, LastUsed: time.Now()}
+		return nil
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+func reservationsCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		r     map[string]Reservation
+		up    []VMInfo
+		names []string
+		pp    []byte
+		using = make(map[string]string)
+	)
+	if r, err = readReservations(); err != nil {
+		return
+	}
+	if up, err = allRunningInstances(); err != nil {
+		return
+	}
+	for _, vm := range up {
+		using[vm.UUID] = vm.Name
+	}
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if engine.rawArgs.GetBool("json") {
+		var all []Reservation
+		for _, name := range names {
+			all = append(all, r[name])
+		}
+		if pp, err = json.MarshalIndent(all, "", "    "); err == nil {
+			fmt.Println(string(pp))
+		}
+		return
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 5, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "name\tuuid\tmac\tlast ip\tlast used\tin use by\n")
+	for _, name := range names {
+		res := r[name]
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", res.Name, res.UUID,
+			res.MacAddress, res.PublicIP,
+			res.LastUsed.Format("2006-01-02 15:04"), using[res.UUID])
+	}
+	w.Flush()
+	return
+}
+
+func reservationsReleaseCommand(cmd *cobra.Command, args []string) error {
+	return updateReservations(func(r map[string]Reservation) error {
+		for _, name := range args {
+			if _, ok := r[name]; !ok {
+				return fmt.Errorf("Aborting: there's no reservation for "+
+					"'%s'", name)
+			}
+		}
+		for _, name := range args {
+			delete(r, name)
+			log.Printf("released reservation of '%s'\n", name)
+		}
+		return nil
+	})
+}
+
+func init() {
+	reservationsCmd.Flags().BoolP("json", "j", false,
+		"outputs in JSON for easy 3rd party integration")
+	reservationsCmd.AddCommand(reservationsReleaseCmd)
+	RootCmd.AddCommand(reservationsCmd)
+}
@@ -27,8 +27,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/TheNewNormal/corectl/bootdisk"
+	"github.com/TheNewNormal/corectl/leases"
 	"github.com/TheNewNormal/corectl/uuid2ip"
 	"github.com/TheNewNormal/libxhyve"
 	"github.com/satori/go.uuid"
@@ -69,9 +72,16 @@ var (
 	}
 )
 
-func runCommand(cmd *cobra.Command, args []string) error {
+func runCommand(cmd *cobra.Command, args []string) (err error) {
 	engine.VMs = append(engine.VMs, vmContext{})
-	return engine.boot(0, engine.rawArgs)
+	if err = engine.boot(0, engine.rawArgs); err != nil {
+		return
+	}
+	// only VMs left running in the background have anything to wait for
+	if vm := engine.VMs[0].vm; vm.Detached {
+		return vm.waitReady()
+	}
+	return
 }
 
 func xhyveCommand(cmd *cobra.Command, args []string) (err error) {
@@ -92,13 +102,39 @@ func xhyveCommand(cmd *cobra.Command, args []string) (err error) {
 	if a2, err = strDecode(args[2]); err != nil {
 		return err
 	}
-	return xhyve.Run(append(strings.Split(a0, " "),
-		"-f", fmt.Sprintf("%s%v", a1, a2)), make(chan string))
+	var (
+		vm          VMInfo
+		rundir      string
+		instr, ptys = strings.Split(a0, " "), make(chan string)
+	)
+	for i, arg := range instr {
+		if arg == "-U" && i+1 < len(instr) {
+			rundir = filepath.Join(engine.runDir, instr[i+1])
+		}
+	}
+	// read now, as the run directory may well be gone once the VM is
+	if buf, e := ioutil.ReadFile(filepath.Join(rundir, "config")); e == nil {
+		vm, _ = decodeVMState(buf)
+	}
+	go relayConsole(rundir, ptys)
+	if err = xhyve.Run(append(instr, "-f", fmt.Sprintf("%s%v", a1, a2)),
+		ptys); err != nil {
+		vm.event(EventCrash, err.Error())
+	} else {
+		vm.event(EventExit, "")
+	}
+	// throwaway clones of snapshots go away with the VM
+	vm.discardClones()
+	return
 }
 
-func vmBootstrap(args *viper.Viper) (vm *VMInfo, err error) {
+// vmBootstrap resolves, and validates, the settings of a VM about to be
+// booted. when just rehearsing (dryRun) nothing gets fetched from upstream
+// nor generated
+func vmBootstrap(args *viper.Viper, dryRun bool) (vm *VMInfo, err error) {
 	vm = new(VMInfo)
-	vm.publicIP = make(chan string)
+	// buffered, as the guest may call back after its IP got known otherwise
+	vm.publicIP = make(chan string, 1)
 	vm.errch, vm.done = make(chan error), make(chan bool)
 
 	vm.PreferLocalImages = args.GetBool("local")
@@ -110,6 +146,12 @@ func vmBootstrap(args *viper.Viper) (vm *VMInfo, err error) {
 
 	vm.Name, vm.UUID = args.GetString("name"), args.GetString("uuid")
 
+	// named VMs keep their UUID, and so their MAC and IP, across boots
+	if vm.UUID == "random" && vm.Name != "" {
+		if reserved := reservedUUID(vm.Name); reserved != "" {
+			vm.UUID = reserved
+		}
+	}
 	if vm.UUID == "random" {
 		vm.UUID = uuid.NewV4().String()
 	} else if _, err = uuid.FromString(vm.UUID); err != nil {
@@ -117,17 +159,22 @@ func vmBootstrap(args *viper.Viper) (vm *VMInfo, err error) {
 			vm.UUID, "    using a randomly generated one")
 		vm.UUID = uuid.NewV4().String()
 	}
-	for {
-		if vm.MacAddress, err = uuid2ip.GuestMACfromUUID(vm.UUID); err != nil {
-			original := args.GetString("uuid")
-			if original != "random" {
-				log.Printf("unable to guess the MAC Address from the provided "+
-					"UUID (%s). Using a randomly generated one\n", original)
-			}
-			vm.UUID = uuid.NewV4().String()
-		} else {
+	// deriving the MAC needs vmnet, and so root, which rehearsals lack. a
+	// vmnet refusing a few fresh UUIDs in a row is not going to budge
+	for attempt := 0; !dryRun; attempt++ {
+		if vm.MacAddress, err = uuid2ip.GuestMACfromUUID(vm.UUID); err == nil {
 			break
 		}
+		if attempt == 3 {
+			return vm, fmt.Errorf("Aborting: unable to derive a MAC "+
+				"Address from any UUID (%v)", err)
+		}
+		original := args.GetString("uuid")
+		if original != "random" {
+			log.Printf("unable to guess the MAC Address from the provided "+
+				"UUID (%s). Using a randomly generated one\n", original)
+		}
+		vm.UUID = uuid.NewV4().String()
 	}
 
 	if vm.Name == "" {
@@ -143,29 +190,52 @@ func vmBootstrap(args *viper.Viper) (vm *VMInfo, err error) {
 			"Another VM is running with same name.", vm.Name)
 	}
 
-	vm.Memory = args.GetInt("memory")
-	if vm.Memory < 1024 {
-		log.Printf("'%v' not a reasonable memory value. %s\n", vm.Memory,
-			"Using '1024', the default")
-		vm.Memory = 1024
-	} else if vm.Memory > 8192 {
-		log.Printf("'%v' not a reasonable memory value. %s %s\n", vm.Memory,
-			"as presently we only support VMs with up to 8GB of RAM.",
-			"setting it to '8192'")
-		vm.Memory = 8192
-	}
+	vm.Memory = normalizeMemory(args.GetInt("memory"))
+	vm.Profile, vm.Index = args.GetString("profile"), args.GetInt("index")
 
-	if vm.Channel, vm.Version, err =
-		lookupImage(normalizeChannelName(args.GetString("channel")),
-			normalizeVersion(args.GetString("version")),
-			false, vm.PreferLocalImages); err != nil {
+	if err = vm.admit(args.GetString("overcommit"),
+		args.GetInt("reserved_memory")); err != nil {
 		return
 	}
 
+	if vm.Boot = args.GetString("boot"); vm.Boot != PXE && vm.Boot != Disk {
+		return vm, fmt.Errorf("Aborting: --boot must be either %s or %s "+
+			"('%s' isn't)", PXE, Disk, vm.Boot)
+	}
+
+	// VMs booting off their root volume don't need any image, as they
+	// run whatever CoreOS got installed there (see inspectRootDisk)
+	if vm.Boot == PXE {
+		if dryRun {
+			var isLocal bool
+			vm.Channel = normalizeChannelName(args.GetString("channel"))
+			if vm.Version, isLocal, err = resolveVersion(vm.Channel,
+				normalizeVersion(args.GetString("version")),
+				vm.PreferLocalImages); err != nil {
+				return
+			}
+			if !isLocal {
+				log.Printf("%s/%s isn't available locally, and would be "+
+					"pulled from upstream\n", vm.Channel, vm.Version)
+			}
+		} else if vm.Channel, vm.Version, err =
+			lookupImage(normalizeChannelName(args.GetString("channel")),
+				normalizeVersion(args.GetString("version")),
+				false, vm.PreferLocalImages); err != nil {
+			return
+		}
+	}
+
 	if err = vm.validateCDROM(args.GetString("cdrom")); err != nil {
 		return
 	}
 
+	if err = vm.validateKernel(args.GetString("kernel"),
+		args.GetString("initrd"),
+		args.GetStringSlice("kernel_arg")); err != nil {
+		return
+	}
+
 	if err = vm.validateVolumes([]string{args.GetString("root")},
 		true); err != nil {
 		return
@@ -174,14 +244,35 @@ func vmBootstrap(args *viper.Viper) (vm *VMInfo, err error) {
 		false); err != nil {
 		return
 	}
+	if vm.Boot == Disk {
+		if err = vm.inspectRootDisk(); err != nil {
+			return
+		}
+	}
 
-	vm.Ethernet = append(vm.Ethernet, NetworkInterface{Type: Raw})
-	if err = vm.addTAPinterface(args.GetString("tap")); err != nil {
+	if err = vm.validateNetworks(args.GetStringSlice("net"),
+		args.GetString("tap")); err != nil {
+		return
+	}
+	// only advisory, to fail early, as it's just when the VM gets claimed,
+	// at boot, that uniqueness is actually enforced
+	if up, e := allRunningInstances(); e != nil {
+		return vm, e
+	} else if err = vm.conflicts(up); err != nil {
+		return
+	}
+	if vm.readiness, err =
+		parseReadyChecks(pSlice(args.GetStringSlice("wait_for"))); err != nil {
 		return
 	}
+	if vm.Boot == Disk {
+		if err = vm.withoutOEM(); err != nil {
+			return
+		}
+	}
 
 	err = vm.validateCloudConfig(args.GetString("cloud_config"))
-	if err != nil {
+	if err != nil || dryRun {
 		return
 	}
 
@@ -197,17 +288,36 @@ func vmBootstrap(args *viper.Viper) (vm *VMInfo, err error) {
 func (running *sessionContext) boot(slt int, rawArgs *viper.Viper) (err error) {
 	var c = new(exec.Cmd)
 
-	if running.VMs[slt].vm, err = vmBootstrap(rawArgs); err != nil {
+	if running.VMs[slt].vm, err = vmBootstrap(rawArgs, false); err != nil {
 		return
 	}
 	vm := running.VMs[slt].vm
 
-	rundir := filepath.Join(running.runDir, vm.UUID)
-	if err = os.RemoveAll(rundir); err != nil {
+	if err = vm.claim(); err != nil {
 		return
 	}
-	if err = os.MkdirAll(rundir, 0755); err != nil {
-		return
+	vm.reserve()
+	for _, d := range vm.Storage.HardDrives {
+		if d.Snapshot != "" {
+			if err = cloneFile(d.Snapshot, d.Path); err != nil {
+				return
+			}
+			// snapshots are read-only, their clones must not
+			if err = os.Chmod(d.Path, 0644); err != nil {
+				return
+			}
+		}
+	}
+	// custom initrds get the very same OEM bits that pulled images do
+	if vm.Initrd != "" {
+		if err = oemify(vm.Initrd, vm.initrdPath(), vm.Version); err != nil {
+			return
+		}
+	}
+	if vm.Boot == Disk {
+		if err = vm.prepareDiskBoot(); err != nil {
+			return
+		}
 	}
 
 	if err = nfsSetup(); err != nil {
@@ -218,85 +328,221 @@ func (running *sessionContext) boot(slt int, rawArgs *viper.Viper) (err error) {
 		return
 	}
 	vm.CreatedAt = time.Now()
-	// saving now, in advance, without Pid to ensure {name,UUID,volumes}
-	// atomicity
 	if err = vm.storeConfig(); err != nil {
 		return
 	}
 
 	go func() {
-		timeout := time.After(30 * time.Second)
-		select {
-		case <-timeout:
-			if p, ee := os.FindProcess(c.Process.Pid); ee == nil {
-				p.Signal(os.Interrupt)
-			}
-			vm.errch <- fmt.Errorf("Unable to grab VM's IP after " +
-				"30s (!)... Aborting")
-		case ip := <-vm.publicIP:
-			// afaict there's no race here, regardless of what `go build -race`
-			// claims as vm.publicIP will only be triggered well after the
-			// c.{Start,Run} calls...
-			vm.Pid, vm.PublicIP = c.Process.Pid, ip
-			if ee := vm.storeConfig(); ee != nil {
-				vm.errch <- ee
-			} else {
-				if vm.Detached {
-					log.Printf("started '%s' in background with IP %v and "+
-						"PID %v\n", vm.Name, vm.PublicIP, c.Process.Pid)
+		var (
+			ip      string
+			timeout = time.After(30 * time.Second)
+			poll    <-chan time.Time
+		)
+		// VMs booting off their root volume lack the OEM bits that call
+		// back, so their DHCP lease gets looked up from the start
+		if vm.Boot == Disk {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+	wait:
+		for {
+			select {
+			case <-poll:
+				if found, ee := leases.Find(leases.DefaultPath,
+					vm.MacAddress); ee == nil {
+					ip = found
+					break wait
+				}
+			case <-timeout:
+				// the guest may never call back (as with custom
+				// cloud-configs that don't fetch the internal ssh key),
+				// leaving its DHCP lease as the only way to tell its IP
+				var ee error
+				if ip, ee = leases.Find(leases.DefaultPath,
+					vm.MacAddress); ee != nil {
+					if p, ee := os.FindProcess(c.Process.Pid); ee == nil {
+						p.Signal(os.Interrupt)
+					}
+					vm.event(EventFailed, "no IP after 30s")
+					vm.errch <- fmt.Errorf("Unable to grab VM's IP after " +
+						"30s (!)... Aborting")
+					return
 				}
-				close(vm.publicIP)
-				close(vm.done)
+				log.Printf("'%s' never called back, got its IP from its "+
+					"DHCP lease instead\n", vm.Name)
+				break wait
+			case ip = <-vm.publicIP:
+				break wait
 			}
 		}
+		// afaict there's no race here, regardless of what `go build -race`
+		// claims as vm.publicIP will only be triggered well after the
+		// c.Start call...
+		vm.Pid, vm.PublicIP = c.Process.Pid, ip
+		if ee := vm.storeConfig(); ee != nil {
+			vm.errch <- ee
+		} else {
+			vm.event(EventIP, ip)
+			vm.reserve()
+			if vm.Detached {
+				log.Printf("started '%s' in background with IP %v and "+
+					"PID %v\n", vm.Name, vm.PublicIP, c.Process.Pid)
+			}
+			close(vm.done)
+		}
 	}()
 
+	// the hypervisor gets a session of its own, so that it outlives both
+	// us and the terminal we're in, with its console reachable through
+	// 'corectl console' (which is what we become when in the foreground)
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = c.Start(); err != nil {
+		return
+	}
+	vm.event(EventBoot, fmt.Sprintf("%s/%s, %v vCPU(s), %vMB RAM, "+
+		"detached=%v", vm.Channel, vm.Version, vm.Cpus, vm.Memory,
+		vm.Detached))
 	go func() {
-		if !vm.Detached {
-			c.Stdout, c.Stdin, c.Stderr = os.Stdout, os.Stdin, os.Stderr
-			vm.errch <- c.Run()
-		} else if ee := c.Start(); ee != nil {
-			vm.errch <- ee
-		} else {
-			select {
-			default:
-				if ee := c.Wait(); ee != nil {
-					log.Println(ee)
-					vm.errch <- fmt.Errorf("VM exited with error " +
-						"while attempting to start in background")
-				}
-			case <-vm.errch:
+		ee := c.Wait()
+		// as otherwise it got to tell by itself
+		if c.ProcessState != nil {
+			if status, ok :=
+				c.ProcessState.Sys().(syscall.WaitStatus); ok &&
+				status.Signaled() {
+				vm.event(EventCrash, ee.Error())
 			}
 		}
+		if ee != nil && vm.Detached {
+			log.Println(ee)
+			vm.errch <- fmt.Errorf("VM exited with error " +
+				"while attempting to start in background")
+		} else {
+			vm.errch <- ee
+		}
 	}()
 
-	for {
+	detached, attached := make(chan bool), make(chan bool)
+	if vm.Detached {
+		close(attached)
+	} else {
+		go func() {
+			defer close(attached)
+			// as before, closing the terminal halts the VM
+			hangup := func() {
+				select {
+				case <-vm.done:
+					vm.halt()
+				default:
+					c.Process.Signal(os.Interrupt)
+				}
+			}
+			d, ee := vm.attachConsole(rawArgs.GetString("detach_keys"),
+				false, 30*time.Second, hangup)
+			if ee != nil {
+				log.Println(ee)
+			}
+			if d {
+				detached <- d
+			}
+		}()
+	}
+
+	for booting := vm.done; ; {
 		select {
-		case <-vm.done:
+		case <-booting:
 			if vm.Detached {
 				return
 			}
+			// so that it doesn't fire again
+			booting = nil
+		case <-detached:
+			log.Printf("'%s' moved to the background\n", vm.Name)
+			// our PID still stands in for the VM's until it gets its IP
+			if booting != nil {
+				select {
+				case <-booting:
+				case ee := <-vm.errch:
+					return ee
+				}
+			}
+			vm.Detached = true
+			return vm.storeConfig()
 		case ee := <-vm.errch:
+			// letting the console restore the terminal first
+			select {
+			case <-attached:
+			case <-time.After(time.Second):
+			}
 			return ee
 		}
-		time.Sleep(250 * time.Millisecond)
 	}
 }
 
+// discardClones removes the throwaway clones of snapshots that the VM was
+// booted on top of
+func (vm *VMInfo) discardClones() {
+	for _, d := range vm.Storage.HardDrives {
+		if d.Snapshot != "" {
+			if err := os.Remove(d.Path); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// repeatable is a flag that may be given more than once and that, unlike
+// string slices, keeps values containing commas (as console=ttyS0,115200 or
+// tap:tap1,ip=10.0.1.5/24) whole
+type repeatable []string
+
+func (r *repeatable) Set(v string) error {
+	*r = append(*r, strings.Fields(v)...)
+	return nil
+}
+func (r *repeatable) String() string { return strings.Join(*r, " ") }
+func (r *repeatable) Type() string   { return "repeatable" }
+
 func runFlagsDefaults(setFlag *pflag.FlagSet) {
 	setFlag.String("channel", "alpha", "CoreOS channel")
 	setFlag.String("version", "latest", "CoreOS version")
-	setFlag.String("uuid", "random", "VM's UUID")
+	setFlag.String("uuid", "random", "VM's UUID (by default the one "+
+		"reserved for its name, if any, or a random one)")
 	setFlag.Int("memory", 1024,
-		"VM's RAM, in MB, per instance (1024 < memory < 8192)")
+		"VM's RAM, in MB, per instance (at least 1024)")
 	setFlag.Int("cpus", 1, "VM's vCPUS")
+	setFlag.String("overcommit", "warn", "what to do when the host lacks "+
+		"free RAM or cores for the VM (either refuse, warn or allow)")
+	setFlag.Int("reserved_memory", 1024,
+		"host RAM, in MB, that VMs aren't expected to use")
 	setFlag.String("cloud_config", "",
 		"cloud-config file location (either a remote URL or a local path)")
 	setFlag.String("sshkey", "", "VM's default ssh key")
-	setFlag.String("root", "", "append a (persistent) root volume to VM")
+	setFlag.String("root", "",
+		"append a (persistent) root volume to VM, by path or volume name")
+	setFlag.String("boot", PXE, "how the VM boots: "+PXE+", into RAM off "+
+		"its channel's image, or "+Disk+", off the CoreOS installed (by "+
+		"coreos-install) in its root volume, keeping its updates, but "+
+		"without corectl's OEM bits (so neither ssh nor what relies on it)")
 	setFlag.String("cdrom", "", "append an CDROM (.iso) to VM")
-	setFlag.StringSlice("volume", nil, "append disk volumes to VM")
-	setFlag.String("tap", "", "append tap interface to VM")
+	setFlag.StringSlice("volume", nil,
+		"append disk volumes to VM, by path or volume name")
+	setFlag.Var(&repeatable{}, "net", "appends a network interface to VM, "+
+		"either nat or tap:DEV, optionally with static settings (as in "+
+		"tap:tap1,ip=10.0.1.5/24,gw=10.0.1.1,dns=8.8.8.8). the first one, "+
+		"and only it, is always nat. may be repeated")
+	setFlag.String("tap", "", "append tap interface to VM (as --net tap:DEV)")
+	setFlag.String("kernel", "",
+		"boots the given (locally built) kernel instead of the channel's")
+	setFlag.String("initrd", "",
+		"boots the given (locally built) initrd instead of the channel's")
+	setFlag.Var(&repeatable{}, "kernel_arg", "appends an argument to the "+
+		"kernel command line or, if prefixed with '-', removes a default "+
+		"one (such as -coreos.autologin). may be repeated")
+	setFlag.StringSlice("wait_for", nil, "conditions that a VM started "+
+		"in the background has to meet, once it got an IP, before being "+
+		"considered up (ssh, tcp:PORT, unit:NAME or http:[PORT]/PATH), "+
+		"each optionally followed by @TIMEOUT (60s by default)")
 	setFlag.BoolP("detached", "d", false,
 		"starts the VM in detached (background) mode")
 	setFlag.BoolP("local", "l", false,
@@ -305,6 +551,9 @@ func runFlagsDefaults(setFlag *pflag.FlagSet) {
 	setFlag.StringP("name", "n", "",
 		"names the VM. (if absent defaults to VM's UUID)")
 
+	setFlag.String("detach_keys", "ctrl-]", "the key sequence that, "+
+		"when in the foreground, moves the VM to the background")
+
 	// available but hidden...
 	setFlag.String("extra", "", "additional arguments to xhyve hypervisor")
 	setFlag.MarkHidden("extra")
@@ -406,16 +655,96 @@ func nfsSetup() (err error) {
 	return
 }
 
+// claim reserves, host wide, the VM's name, UUID, volumes and tap device,
+// by saving its config in advance, owned by this very process until the
+// hypervisor's one takes over. as claims are only honoured while their
+// owner is alive, those of VMs that died get released on their own
+func (vm *VMInfo) claim() (err error) {
+	var (
+		lock   *os.File
+		up     []VMInfo
+		rundir = filepath.Join(engine.runDir, vm.UUID)
+	)
+	if lock, err = lockRunning(); err != nil {
+		return
+	}
+	defer lock.Close()
+	if up, err = allRunningInstances(); err != nil {
+		return
+	}
+	if err = vm.conflicts(up); err != nil {
+		return
+	}
+	if err = os.RemoveAll(rundir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(rundir, 0755); err != nil {
+		return
+	}
+	vm.Pid = os.Getpid()
+	return vm.storeConfig()
+}
+
+// lockRunning takes the lock under which VMs get claimed, so that what's
+// checked against the running VMs (and the volumes they hold) stays true
+// until it gets released. the lock goes away with the returned file's
+// closing, so also if we die
+func lockRunning() (lock *os.File, err error) {
+	if lock, err = os.OpenFile(filepath.Join(engine.runDir, ".lock"),
+		os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return
+}
+
+// conflicts tells whether the VM would share its name, UUID, volumes or
+// tap device with any of the given (running) ones
+func (vm *VMInfo) conflicts(up []VMInfo) error {
+	for _, d := range up {
+		if d.UUID == vm.UUID {
+			return fmt.Errorf("%s %s (%s)\n", "Aborting.",
+				"Another VM is running with same UUID.", vm.UUID)
+		}
+		if d.Name == vm.Name {
+			return fmt.Errorf("%s %s (%s)\n", "Aborting.",
+				"Another VM is running with same name.", vm.Name)
+		}
+		for _, vv := range d.Storage.HardDrives {
+			for _, v := range vm.Storage.HardDrives {
+				if v.Path == vv.Path {
+					return fmt.Errorf("Aborting: %s %s (%s)", v.Path,
+						"already being used as a volume by another VM.",
+						d.Name)
+				}
+			}
+		}
+		for _, ee := range d.Ethernet {
+			for _, e := range vm.Ethernet {
+				if e.Type == Tap && ee.Type == Tap && e.Path == ee.Path {
+					return fmt.Errorf("Aborting: %s already being used "+
+						"by another VM (%s)", e.Path, d.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (vm *VMInfo) storeConfig() (err error) {
 	rundir := filepath.Join(engine.runDir, vm.UUID)
+	vm.SchemaVersion = vmSchemaVersion
 	cfg, _ := json.MarshalIndent(vm, "", "    ")
 
 	if engine.debug {
 		fmt.Println(string(cfg))
 	}
 
-	if err = ioutil.WriteFile(fmt.Sprintf("%s/config", rundir),
-		[]byte(cfg), 0644); err != nil {
+	if err = writeFileAtomic(filepath.Join(rundir, "config"),
+		cfg, 0644); err != nil {
 		return
 	}
 
@@ -423,39 +752,73 @@ func (vm *VMInfo) storeConfig() (err error) {
 }
 
 func (vm *VMInfo) assembleBootPayload() (cmd *exec.Cmd, err error) {
+	var endpoint string
+
+	if endpoint, err = vm.metadataService(); err != nil {
+		return
+	}
+	instr, kexec, cmdline := vm.hypervisorArgs(endpoint)
+
+	strEncode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return exec.Command(os.Args[0], "xhyve",
+			strEncode(strings.Join(instr, " ")),
+			strEncode(kexec), strEncode(cmdline)),
+		err
+}
+
+// hypervisorArgs returns the arguments with which xhyve is to be invoked in
+// order to boot the VM, being given the metadata service's endpoint
+func (vm *VMInfo) hypervisorArgs(endpoint string) (instr []string,
+	kexec, cmdline string) {
 	var (
-		cmdline = fmt.Sprintf("%s %s %s %s",
-			"earlyprintk=serial", "console=ttyS0", "coreos.autologin",
-			"uuid="+vm.UUID)
 		prefix  = "coreos_production_pxe"
 		vmlinuz = fmt.Sprintf("%s/%s/%s/%s.vmlinuz",
 			engine.imageDir, vm.Channel, vm.Version, prefix)
 		initrd = fmt.Sprintf("%s/%s/%s/%s_image.cpio.gz",
 			engine.imageDir, vm.Channel, vm.Version, prefix)
-		instr = []string{
-			"libxhyve_bug",
-			"-s", "0:0,hostbridge",
-			"-l", "com1,stdio",
-			"-s", "31,lpc",
-			"-U", vm.UUID,
-			"-m", fmt.Sprintf("%vM", vm.Memory),
-			"-c", fmt.Sprintf("%v", vm.Cpus),
-			"-A",
-		}
-		endpoint string
+		args []string
 	)
+	if vm.Kernel != "" {
+		vmlinuz = vm.Kernel
+	}
+	if vm.Initrd != "" {
+		initrd = vm.initrdPath()
+	}
+	if vm.Boot == Disk {
+		// CoreOS' kernels have their initramfs built in
+		vmlinuz, initrd = vm.diskKernelPath(), ""
+	}
+	for _, a := range defaultKernelArgs {
+		if !vm.dropsKernelArg(a) {
+			args = append(args, a)
+		}
+	}
+	cmdline = strings.Join(append(args, "uuid="+vm.UUID), " ")
+	instr = []string{
+		"libxhyve_bug",
+		"-s", "0:0,hostbridge",
+		// the serial console gets relayed, and logged, by relayConsole
+		"-l", "com1,autopty=" + filepath.Join(engine.runDir, vm.UUID, "tty"),
+		"-s", "31,lpc",
+		"-U", vm.UUID,
+		"-m", fmt.Sprintf("%vM", vm.Memory),
+		"-c", fmt.Sprintf("%v", vm.Cpus),
+		"-A",
+	}
 
 	if vm.SSHkey != "" {
 		cmdline = fmt.Sprintf("%s sshkey=\"%s\"", cmdline, vm.SSHkey)
 	}
 
-	if vm.Root != -1 {
+	if vm.Boot == Disk && vm.diskBoot != nil {
+		cmdline = fmt.Sprintf("%s %s",
+			cmdline, strings.Join(vm.diskBoot.Cmdline, " "))
+	} else if vm.Root != -1 {
 		cmdline = fmt.Sprintf("%s root=/dev/vd%s", cmdline, string(vm.Root+'a'))
 	}
 
-	if endpoint, err = vm.metadataService(); err != nil {
-		return
-	}
 	cmdline = fmt.Sprintf("%s endpoint=%s", cmdline, endpoint)
 
 	if vm.CloudConfig != "" {
@@ -468,6 +831,12 @@ func (vm *VMInfo) assembleBootPayload() (cmd *exec.Cmd, err error) {
 		}
 	}
 
+	for _, a := range vm.KernelArgs {
+		if !strings.HasPrefix(a, "-") {
+			cmdline = fmt.Sprintf("%s %s", cmdline, a)
+		}
+	}
+
 	if vm.Extra != "" {
 		instr = append(instr, vm.Extra)
 	}
@@ -490,14 +859,162 @@ func (vm *VMInfo) assembleBootPayload() (cmd *exec.Cmd, err error) {
 		instr = append(instr, "-s", fmt.Sprintf("4:%d,virtio-blk,%s",
 			v.Slot, v.Path))
 	}
-	strEncode := func(s string) string {
-		return base64.StdEncoding.EncodeToString([]byte(s))
+	kexec = fmt.Sprintf("kexec,%s,%s,", vmlinuz, initrd)
+	return
+}
+
+// initrdPath is where the OEMified copy of a custom initrd is kept, while
+// the VM runs
+func (vm *VMInfo) initrdPath() string {
+	return filepath.Join(engine.runDir, vm.UUID, "initrd.cpio.gz")
+}
+
+// diskKernelPath is where the kernel that the VM's root volume boots is
+// kept, while the VM runs
+func (vm *VMInfo) diskKernelPath() string {
+	return filepath.Join(engine.runDir, vm.UUID, "vmlinuz")
+}
+
+// inspectRootDisk finds out what the VM's root volume, as laid down by
+// coreos-install, boots by itself
+func (vm *VMInfo) inspectRootDisk() (err error) {
+	if vm.Root == -1 {
+		return fmt.Errorf("Aborting: --boot %s needs the volume to boot "+
+			"from, as --root", Disk)
 	}
-	return exec.Command(os.Args[0], "xhyve",
-			strEncode(strings.Join(instr, " ")),
-			strEncode(fmt.Sprintf("kexec,%s,%s,", vmlinuz, initrd)),
-			strEncode(fmt.Sprintf("%v", cmdline))),
-		err
+	if vm.Kernel != "" || vm.Initrd != "" {
+		return fmt.Errorf("Aborting: --kernel and --initrd can't be used "+
+			"along --boot %s, as the root volume brings its own", Disk)
+	}
+	d := vm.Storage.HardDrives[strconv.Itoa(vm.Root)]
+	// snapshots only get cloned at boot time
+	source := d.Path
+	if d.Snapshot != "" {
+		source = d.Snapshot
+	}
+	if vm.diskBoot, err = bootdisk.Open(source); err != nil {
+		return fmt.Errorf("Aborting: unable to boot off the root volume "+
+			"(%v)", err)
+	}
+	vm.BootSlot = vm.diskBoot.Slot
+	vm.Channel, vm.Version = vm.diskBoot.Channel, vm.diskBoot.Version
+	if vm.Channel == "" {
+		vm.Channel = "unknown"
+	}
+	if vm.Version == "" {
+		vm.Version = "unknown"
+	}
+	return
+}
+
+// withoutOEM rejects the settings that rely on corectl's OEM bits, which VMs
+// booting off their root volume don't get, as their OEM partition is
+// whatever coreos-install laid down there. their cloud-configs still get
+// fetched, by CoreOS itself, off the kernel command line
+func (vm *VMInfo) withoutOEM() (err error) {
+	var unmet []string
+	if vm.SSHkey != "" {
+		unmet = append(unmet, "--sshkey")
+	}
+	for _, c := range vm.readiness {
+		if c.kind == "ssh" || c.kind == "unit" {
+			unmet = append(unmet, "--wait_for "+c.spec)
+		}
+	}
+	for _, e := range vm.Ethernet {
+		if e.Address != "" || e.Gateway != "" || len(e.DNS) > 0 {
+			unmet = append(unmet, "--net "+e.String())
+		}
+	}
+	if len(unmet) > 0 {
+		return fmt.Errorf("Aborting: %s can't be used along --boot %s, as "+
+			"VMs booting off their root volume lack corectl's OEM bits "+
+			"(set things up via --cloud_config instead)",
+			strings.Join(unmet, ", "), Disk)
+	}
+	for _, d := range vm.volumesToGrow(false) {
+		log.Printf("the filesystem in %s won't be grown, as VMs booting off "+
+			"their root volume lack corectl's OEM bits\n", d)
+	}
+	return
+}
+
+// prepareDiskBoot puts aside the kernel that the VM's root volume boots and,
+// as grub would, uses up one of the tries of a freshly updated /usr
+// partition, so that a broken update gets rolled back on the next boot
+func (vm *VMInfo) prepareDiskBoot() (err error) {
+	var f *os.File
+	if err = ioutil.WriteFile(vm.diskKernelPath(),
+		vm.diskBoot.Kernel, 0644); err != nil {
+		return
+	}
+	if f, err = os.OpenFile(vm.Storage.HardDrives[strconv.Itoa(vm.Root)].Path,
+		os.O_RDWR, 0); err != nil {
+		return
+	}
+	defer f.Close()
+	return vm.diskBoot.Commit(f)
+}
+
+// validateKernel checks the custom kernel and initrd, if any, that the VM is
+// to boot instead of its channel's, and the changes to its kernel command
+// line, where arguments prefixed with '-' remove default ones
+func (vm *VMInfo) validateKernel(kernel, initrd string,
+	args []string) (err error) {
+	if vm.Kernel, err = bootArtifact(kernel); err != nil {
+		return
+	}
+	if vm.Initrd, err = bootArtifact(initrd); err != nil {
+		return
+	}
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		removable := false
+		for _, d := range defaultKernelArgs {
+			removable = removable || kernelArgKey(d) == a[1:]
+		}
+		if !removable {
+			return fmt.Errorf("Aborting: '%s' doesn't remove any of the "+
+				"default kernel arguments (%s)", a,
+				strings.Join(defaultKernelArgs, " "))
+		}
+	}
+	vm.KernelArgs = args
+	return
+}
+
+func bootArtifact(path string) (abs string, err error) {
+	var fi os.FileInfo
+	if path == "" {
+		return
+	}
+	if abs, err = filepath.Abs(path); err != nil {
+		return
+	}
+	if fi, err = os.Stat(abs); err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		return abs, fmt.Errorf("Aborting: %s isn't a regular file", abs)
+	}
+	return
+}
+
+func kernelArgKey(arg string) string {
+	return strings.SplitN(arg, "=", 2)[0]
+}
+
+// dropsKernelArg tells whether the given default kernel argument was asked
+// to be removed
+func (vm *VMInfo) dropsKernelArg(arg string) bool {
+	for _, a := range vm.KernelArgs {
+		if a == "-"+kernelArgKey(arg) {
+			return true
+		}
+	}
+	return false
 }
 
 func (vm *VMInfo) validateCloudConfig(config string) (err error) {
@@ -513,13 +1030,17 @@ func (vm *VMInfo) validateCloudConfig(config string) (err error) {
 	if err == nil && (response.StatusCode == http.StatusOK ||
 		response.StatusCode == http.StatusNoContent) {
 		vm.CClocation = Remote
+		vm.CCsum = cloudConfigSum(vm.CloudConfig)
 		return
 	}
 	if _, err = os.Stat(config); err != nil {
 		return
 	}
-	vm.CloudConfig = filepath.Join(engine.pwd, config)
+	if vm.CloudConfig = config; !filepath.IsAbs(config) {
+		vm.CloudConfig = filepath.Join(engine.pwd, config)
+	}
 	vm.CClocation = Local
+	vm.CCsum = cloudConfigSum(vm.CloudConfig)
 	return
 }
 
@@ -545,69 +1066,36 @@ func (vm *VMInfo) validateCDROM(path string) (err error) {
 	return
 }
 
-func (vm *VMInfo) addTAPinterface(tap string) (err error) {
-	if tap == "" {
-		return
-	}
-	var dir, dev string
-	if dir = filepath.Dir(tap); !strings.HasPrefix(dir, "/dev") {
-		return fmt.Errorf("Aborting: '%v' not a valid tap device...", tap)
-	}
-	if dev = filepath.Base(tap); !strings.HasPrefix(dev, "tap") {
-		return fmt.Errorf("Aborting: '%v' not a valid tap device...", tap)
-	}
-	if _, err = os.Stat(tap); err != nil {
-		return
-	}
-	// check atomicity
-	var up []VMInfo
-	if up, err = allRunningInstances(); err != nil {
-		return
-	}
-	for _, d := range up {
-		for _, vv := range d.Ethernet {
-			if dev == vv.Path {
-				return fmt.Errorf("Aborting: %s already being used  "+
-					"by another VM (%s)", dev,
-					d.Name)
-			}
-		}
-	}
-	vm.Ethernet = append(vm.Ethernet, NetworkInterface{
-		Type: Tap, Path: dev,
-	})
-	return
-}
-
 func (vm *VMInfo) validateVolumes(volumes []string, root bool) (err error) {
-	var abs string
+	var abs, snapshot string
 	for _, j := range volumes {
 		if j != "" {
-			if _, err = os.Stat(j); err != nil {
-				return
-			}
-			if abs, err = filepath.Abs(j); err != nil {
-				return
-			}
-			if !strings.HasSuffix(j, ".img") {
-				return fmt.Errorf("Aborting: --volume payload MUST end"+
-					" in '.img' ('%s' doesn't)", j)
-			}
-			// check atomicity
-			var up []VMInfo
-			if up, err = allRunningInstances(); err != nil {
-				return
-			}
-			for _, d := range up {
-				for _, vv := range d.Storage.HardDrives {
-					if abs == vv.Path {
-						return fmt.Errorf("Aborting: %s %s (%s)", abs,
-							"already being used as a volume by another VM.",
-							vv.Path)
+			if volume, snap, ok := snapshotRef(j); ok {
+				// the VM gets a throwaway clone of the snapshot, made at
+				// boot time and discarded once it halts
+				snapshot = snapshotPath(volume, snap)
+				if _, err = os.Stat(snapshot); err != nil {
+					return fmt.Errorf("Aborting: no snapshot named '%s' "+
+						"(see 'corectl volume ls')", j)
+				}
+				abs = filepath.Join(engine.runDir, vm.UUID, j+".img")
+			} else {
+				if abs, err = volumePath(j); err != nil {
+					return
+				}
+				if _, err = os.Stat(abs); err != nil {
+					if isVolumeName(j) && os.IsNotExist(err) {
+						err = fmt.Errorf("Aborting: no volume named '%s' "+
+							"(see 'corectl volume ls')", j)
 					}
+					return
+				}
+				if !strings.HasSuffix(abs, ".img") {
+					return fmt.Errorf("Aborting: --volume payload MUST be "+
+						"a volume name or end in '.img' ('%s' doesn't)", j)
 				}
+				snapshot = ""
 			}
-
 			if vm.Storage.HardDrives == nil {
 				vm.Storage.HardDrives = make(map[string]StorageDevice, 0)
 			}
@@ -620,7 +1108,7 @@ func (vm *VMInfo) validateVolumes(volumes []string, root bool) (err error) {
 				}
 			}
 			vm.Storage.HardDrives[strconv.Itoa(slot)] = StorageDevice{
-				Type: HDD, Slot: slot, Path: abs,
+				Type: HDD, Slot: slot, Path: abs, Snapshot: snapshot,
 			}
 			if root {
 				vm.Root = slot
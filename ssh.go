@@ -98,10 +98,16 @@ func (c *sshClient) close() {
 	terminal.Restore(c.fd, c.oldState)
 }
 
-func (vm VMInfo) startSSHsession() (c *sshClient, err error) {
+// sshDial connects to the VM's sshd, as the core user, retrying for up to
+// the given period while it isn't reachable
+func (vm VMInfo) sshDial(wait time.Duration) (conn *ssh.Client, err error) {
 	var secret ssh.Signer
-	c = &sshClient{}
 
+	// the internal ssh key gets into the VM through corectl's OEM bits
+	if vm.Boot == Disk {
+		return nil, fmt.Errorf("'%s' boots off its root volume, which "+
+			"lacks corectl's OEM bits and so its internal ssh key", vm.Name)
+	}
 	if secret, err = ssh.ParsePrivateKey(
 		[]byte(vm.InternalSSHprivKey)); err != nil {
 		return
@@ -111,19 +117,28 @@ func (vm VMInfo) startSSHsession() (c *sshClient, err error) {
 		User: "core", Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(secret),
 		},
+		Timeout: 2 * time.Second,
 	}
 
-	//wait a bit for VM's ssh to be available...
-	for {
-		var e error
-		if c.conn, e = ssh.Dial("tcp", vm.PublicIP+":22", config); e == nil {
+	for deadline := time.Now().Add(wait); ; {
+		if conn, err = ssh.Dial("tcp", vm.PublicIP+":22",
+			config); err == nil || time.Now().After(deadline) {
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
-		select {
-		case <-time.After(time.Second * 5):
-			return c, fmt.Errorf("%s unreachable", vm.PublicIP+":22")
-		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s unreachable (%v)", vm.PublicIP+":22", err)
+	}
+	return
+}
+
+func (vm VMInfo) startSSHsession() (c *sshClient, err error) {
+	c = &sshClient{}
+
+	//wait a bit for VM's ssh to be available...
+	if c.conn, err = vm.sshDial(5 * time.Second); err != nil {
+		return
 	}
 
 	if c.session, err = c.conn.NewSession(); err != nil {
@@ -0,0 +1,146 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	unloadCmd = &cobra.Command{
+		Use:   "unload path/to/yourProfile",
+		Short: "Halts CoreOS instances defined in an instrumentation file.",
+		Long: "Halts CoreOS instances defined in an instrumentation file " +
+			"(either in TOML, JSON or YAML format).\n" + "VMs are halted " +
+			"in the reverse order by which 'load' boots them, and the ones " +
+			"that aren't running are skipped.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if len(args) != 1 {
+				return fmt.Errorf("Incorrect usage: " +
+					"This command requires one argument (a file path)")
+			}
+			engine.rawArgs.BindPFlags(cmd.Flags())
+			return
+		},
+		RunE: unloadCommand,
+		Example: `  corectl unload profiles/demo.toml
+  corectl unload --purge profiles/demo.toml // also removes the volumes
+                                            // marked as ephemeral`,
+	}
+)
+
+func unloadCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		vmDefs  map[string]*viper.Viper
+		ordered []string
+		vm      VMInfo
+	)
+
+	if vmDefs, ordered, err = loadProfile(args[0]); err != nil {
+		return
+	}
+	for i := len(ordered) - 1; i >= 0; i-- {
+		name := ordered[i]
+		if vm, err = vmInfo(name); err != nil {
+			log.Printf("'%s' isn't running, skipping\n", name)
+		} else {
+			fmt.Println("> halting", name)
+			if err = vm.halt(); err != nil {
+				return
+			}
+		}
+		if engine.rawArgs.GetBool("purge") {
+			if err = purgeEphemeralVolumes(vmDefs[name]); err != nil {
+				return
+			}
+		}
+	}
+	return nil
+}
+
+// purgeEphemeralVolumes removes from disk the volumes that a profile entry
+// flags as ephemeral, as long as these are volumes of that same entry and
+// no running VM is still holding them
+func purgeEphemeralVolumes(args *viper.Viper) (err error) {
+	var (
+		up       []VMInfo
+		abs      string
+		declared = make(map[string]bool)
+	)
+
+	for _, v := range append(pSlice(args.GetStringSlice("volume")),
+		args.GetString("root")) {
+		if v != "" {
+			if abs, err = volumePath(v); err != nil {
+				return
+			}
+			declared[abs] = true
+		}
+	}
+	if up, err = allRunningInstances(); err != nil {
+		return
+	}
+	for _, v := range pSlice(args.GetStringSlice("ephemeral")) {
+		if v == "" {
+			continue
+		}
+		if abs, err = volumePath(v); err != nil {
+			return
+		}
+		if !declared[abs] {
+			return fmt.Errorf("Aborting: '%s' is marked as ephemeral but "+
+				"isn't a volume of '%s'", v, args.GetString("name"))
+		}
+		for _, d := range up {
+			for _, vv := range d.Storage.HardDrives {
+				if abs == vv.Path {
+					return fmt.Errorf("Aborting: %s %s (%s)", abs,
+						"still being used as a volume by another VM.",
+						d.Name)
+				}
+			}
+		}
+		// managed volumes go away along with their metadata
+		target := abs
+		if isVolumeName(v) {
+			target = filepath.Dir(abs)
+		}
+		if _, err = os.Stat(target); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		if err = os.RemoveAll(target); err != nil {
+			return
+		}
+		log.Printf("removed ephemeral volume '%s'\n", v)
+	}
+	return
+}
+
+func init() {
+	unloadCmd.Flags().Bool("purge", false,
+		"removes the volumes that the profile marks as ephemeral")
+	RootCmd.AddCommand(unloadCmd)
+}
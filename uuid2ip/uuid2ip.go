@@ -25,11 +25,7 @@ package uuid2ip
 import "C"
 import (
 	"fmt"
-	"io/ioutil"
 	"net"
-	"os"
-	"regexp"
-	"strings"
 	"unsafe"
 )
 
@@ -49,45 +45,3 @@ func GuestMACfromUUID(uuid string) (mac string, err error) {
 	}
 	return
 }
-
-// GuestIPfromMAC returns the IP address that would be leased to the given MAC
-// address by xhyve, to be called after actual xhyve invocation
-func GuestIPfromMAC(mac string) (ip string, err error) {
-	var (
-		f          *os.File
-		allLeases  []byte
-		lastFound  string
-		leasesPath = "/var/db/dhcpd_leases"
-		ipAddrRe   = regexp.MustCompile(`^.*ip_address=(.+?)$`)
-		macAddrRe  = regexp.MustCompile(`^.*hw_address=1,(.+?)$`)
-	)
-
-	if f, err = os.Open(leasesPath); err != nil {
-		return
-	}
-	defer f.Close()
-
-	if allLeases, err = ioutil.ReadAll(f); err != nil {
-		return
-	}
-
-	for _, l := range strings.Split(string(allLeases), "\n") {
-		l = strings.TrimRight(l, "\r")
-
-		matches := ipAddrRe.FindStringSubmatch(l)
-		if matches != nil {
-			lastFound = matches[1]
-			continue
-		}
-
-		matches = macAddrRe.FindStringSubmatch(l)
-		// OSX's dhcp stores technically incorrect mac addr as it strips
-		// leading zeros from them, so we need to take that in consideration
-		// before checking match...
-		if matches != nil && strings.EqualFold(matches[1],
-			strings.TrimPrefix(strings.Replace(mac, ":0", ":", -1), "0")) {
-			return lastFound, nil
-		}
-	}
-	return ip, fmt.Errorf("%s isn't in ANY active DHCP lease (!)", mac)
-}
@@ -0,0 +1,160 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package vdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	qcow2OffsetMask = 0x00fffffffffffe00
+	qcow2Compressed = 1 << 62
+	qcow2Zero       = 1
+)
+
+// qcow2 is QEMU's copy on write format, versions 2 and 3
+type qcow2 struct {
+	f                     *os.File
+	size, clusterSize     int64
+	clusterBits           uint32
+	l1                    []uint64
+	l2                    []uint64
+	l2Offset, cachedIndex uint64
+	cached                []byte
+}
+
+func openQcow2(f *os.File) (d Disk, err error) {
+	var (
+		header = make([]byte, 112)
+		q      = &qcow2{f: f}
+		buf    []byte
+	)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return
+	}
+	be := binary.BigEndian
+	version := be.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, unsupported("qcow2", fmt.Sprintf("version %v", version))
+	}
+	if be.Uint64(header[8:]) != 0 {
+		return nil, unsupported("qcow2", "with a backing file")
+	}
+	if be.Uint32(header[32:]) != 0 {
+		return nil, unsupported("qcow2", "that are encrypted")
+	}
+	if version == 3 {
+		// corrupt, external data file and extended L2 entries
+		if be.Uint64(header[72:])&(1<<1|1<<2|1<<4) != 0 {
+			return nil, unsupported("qcow2",
+				"that are corrupt or use external data or subclusters")
+		}
+		if be.Uint32(header[100:]) > 104 && header[104] != 0 {
+			return nil, unsupported("qcow2", "compressed with zstd")
+		}
+	}
+	q.clusterBits = be.Uint32(header[20:])
+	if q.clusterBits < 9 || q.clusterBits > 21 {
+		return nil, fmt.Errorf("qcow2 image with an invalid cluster size")
+	}
+	q.clusterSize = 1 << q.clusterBits
+	q.size = int64(be.Uint64(header[24:]))
+
+	buf = make([]byte, 8*int64(be.Uint32(header[36:])))
+	if _, err = f.ReadAt(buf, int64(be.Uint64(header[40:]))); err != nil {
+		return
+	}
+	for i := 0; i < len(buf); i += 8 {
+		q.l1 = append(q.l1, be.Uint64(buf[i:]))
+	}
+	return q, nil
+}
+
+func (q *qcow2) Size() int64    { return q.size }
+func (q *qcow2) Format() string { return "qcow2" }
+func (q *qcow2) Close() error   { return q.f.Close() }
+
+// entry returns the L2 entry that maps the given guest cluster
+func (q *qcow2) entry(cluster int64) (e uint64, err error) {
+	var (
+		perTable = q.clusterSize / 8
+		l1Index  = cluster / perTable
+	)
+	if l1Index >= int64(len(q.l1)) {
+		return
+	}
+	offset := q.l1[l1Index] & qcow2OffsetMask
+	if offset == 0 {
+		return
+	}
+	if offset != q.l2Offset {
+		buf := make([]byte, q.clusterSize)
+		if err = readFull(q.f, buf, int64(offset)); err != nil {
+			return
+		}
+		q.l2 = make([]uint64, perTable)
+		for i := range q.l2 {
+			q.l2[i] = binary.BigEndian.Uint64(buf[i*8:])
+		}
+		q.l2Offset = offset
+	}
+	return q.l2[cluster%perTable], nil
+}
+
+func (q *qcow2) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(p, off, q.size, q.readCluster)
+}
+
+func (q *qcow2) readCluster(p []byte, off int64) (n int, err error) {
+	var e uint64
+
+	cluster, within, n := span(p, off, q.clusterSize)
+	if e, err = q.entry(cluster); err != nil {
+		return
+	}
+	switch {
+	case e&qcow2Compressed != 0:
+		var (
+			shift   = 62 - (q.clusterBits - 8)
+			host    = e & (1<<shift - 1)
+			sectors = (e>>shift)&(1<<(q.clusterBits-8)-1) + 1
+		)
+		if q.cached == nil || q.cachedIndex != host {
+			compressed := make([]byte, sectors*512)
+			if err = readFull(q.f, compressed, int64(host)); err != nil {
+				return
+			}
+			q.cached = make([]byte, q.clusterSize)
+			if _, err = io.ReadFull(flate.NewReader(
+				bytes.NewReader(compressed)), q.cached); err != nil {
+				q.cached = nil
+				return
+			}
+			q.cachedIndex = host
+		}
+		copy(p[:n], q.cached[within:])
+	case e&qcow2OffsetMask == 0 || e&qcow2Zero != 0:
+		zero(p[:n])
+	default:
+		err = readFull(q.f, p[:n], int64(e&qcow2OffsetMask)+within)
+	}
+	return
+}
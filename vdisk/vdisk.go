@@ -0,0 +1,144 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package vdisk reads the disk images of other hypervisors (QEMU's qcow2,
+// VMware's and VirtualBox's vmdk and Hyper-V's and Virtual PC's vhd) as if
+// they were plain raw disks, without ever loading them whole into memory.
+package vdisk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Disk is a virtual disk, read as if it were a raw one. unallocated areas
+// read as zeroes
+type Disk interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the disk's virtual size, in bytes
+	Size() int64
+	// Format names the disk's on-disk format
+	Format() string
+}
+
+// Open detects the format of the given disk image, by its contents, and
+// opens it
+func Open(path string) (d Disk, err error) {
+	var (
+		f    *os.File
+		fi   os.FileInfo
+		head = make([]byte, 512)
+		tail = make([]byte, 512)
+	)
+
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	// descriptors of vmdks made of separate extents can be tiny
+	if err = readFull(f, head, 0); err != nil {
+		return
+	}
+	if bytes.HasPrefix(head, []byte("# Disk DescriptorFile")) {
+		f.Close()
+		return openVmdkDescriptor(path)
+	}
+	if fi.Size() < 512 {
+		return nil, fmt.Errorf("%s is too small to be a disk image", path)
+	}
+	if _, err = f.ReadAt(tail, fi.Size()-512); err != nil {
+		return
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("QFI\xfb")):
+		return openQcow2(f)
+	case bytes.HasPrefix(head, []byte("KDMV")):
+		return openVmdkSparse(f, fi.Size())
+	case bytes.HasPrefix(tail, []byte("conectix")):
+		return openVhd(f, tail)
+	// dynamic VHDs also carry a copy of the footer at their very beginning
+	case bytes.HasPrefix(head, []byte("conectix")):
+		return openVhd(f, head)
+	case bytes.HasPrefix(head, []byte("vhdxfile")):
+		return nil, fmt.Errorf("%s is a VHDX, which isn't supported "+
+			"(only VHD is)", path)
+	}
+	return nil, fmt.Errorf("%s isn't a qcow2, vmdk or vhd disk image", path)
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// readFull is as io.ReaderAt's ReadAt but tolerates reads that go past the
+// end of the file, which compressed payloads at the end of images can do
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if err == io.EOF && n > 0 {
+		zero(p[n:])
+		return nil
+	}
+	return err
+}
+
+// span splits a read of p at off in the chunk of chunkSize bytes it starts
+// in, returning the offset within the chunk and how many bytes to read
+func span(p []byte, off, chunkSize int64) (chunk, within int64, n int) {
+	chunk, within = off/chunkSize, off%chunkSize
+	n = len(p)
+	if left := chunkSize - within; int64(n) > left {
+		n = int(left)
+	}
+	return
+}
+
+// readAt implements ReadAt's bounds checking on top of a function that
+// reads within a single chunk of the disk
+func readAt(p []byte, off, size int64,
+	read func(p []byte, off int64) (int, error)) (total int, err error) {
+	if off >= size {
+		return 0, io.EOF
+	}
+	if left := size - off; int64(len(p)) > left {
+		p, err = p[:left], io.EOF
+	}
+	for total < len(p) {
+		n, e := read(p[total:], off+int64(total))
+		if e != nil {
+			return total, e
+		}
+		total += n
+	}
+	return
+}
+
+func unsupported(format, what string) error {
+	return fmt.Errorf("%s disks %s aren't supported", format,
+		strings.TrimSpace(what))
+}
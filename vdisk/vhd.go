@@ -0,0 +1,137 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	vhdFixed        = 2
+	vhdDynamic      = 3
+	vhdDifferencing = 4
+	vhdUnallocated  = 0xffffffff
+	vhdSectorSize   = 512
+)
+
+// vhd is Virtual PC's and Hyper-V's (first) format, either fixed, which is
+// just a raw disk followed by a footer, or dynamic
+type vhd struct {
+	f          *os.File
+	size       int64
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+	// the sector bitmap of the last block read
+	bitmap      []byte
+	bitmapIndex int64
+}
+
+func openVhd(f *os.File, footer []byte) (d Disk, err error) {
+	var (
+		be     = binary.BigEndian
+		v      = &vhd{f: f, bitmapIndex: -1}
+		header = make([]byte, 1024)
+	)
+	v.size = int64(be.Uint64(footer[48:]))
+	switch be.Uint32(footer[60:]) {
+	case vhdFixed:
+		return v, nil
+	case vhdDynamic:
+	case vhdDifferencing:
+		return nil, unsupported("vhd", "that are differencing ones")
+	default:
+		return nil, fmt.Errorf("vhd with an unknown disk type")
+	}
+
+	if err = readFull(f, header, int64(be.Uint64(footer[16:]))); err != nil {
+		return
+	}
+	if !bytes.HasPrefix(header, []byte("cxsparse")) {
+		return nil, fmt.Errorf("dynamic vhd without a valid header")
+	}
+	v.blockSize = int64(be.Uint32(header[32:]))
+	if v.blockSize == 0 || v.blockSize%vhdSectorSize != 0 {
+		return nil, fmt.Errorf("vhd with an invalid block size")
+	}
+	// one bit per sector, padded to a sector boundary
+	v.bitmapSize = (v.blockSize/vhdSectorSize + 7) / 8
+	v.bitmapSize = (v.bitmapSize + vhdSectorSize - 1) /
+		vhdSectorSize * vhdSectorSize
+
+	buf := make([]byte, 4*int64(be.Uint32(header[28:])))
+	if err = readFull(f, buf, int64(be.Uint64(header[16:]))); err != nil {
+		return
+	}
+	for i := 0; i < len(buf); i += 4 {
+		v.bat = append(v.bat, be.Uint32(buf[i:]))
+	}
+	return v, nil
+}
+
+func (v *vhd) Size() int64    { return v.size }
+func (v *vhd) Format() string { return "vhd" }
+func (v *vhd) Close() error   { return v.f.Close() }
+
+func (v *vhd) ReadAt(p []byte, off int64) (int, error) {
+	if v.bat == nil {
+		return readAt(p, off, v.size, func(p []byte, off int64) (int, error) {
+			return len(p), readFull(v.f, p, off)
+		})
+	}
+	return readAt(p, off, v.size, v.readSectors)
+}
+
+// readSectors reads within a single block, as each one of a dynamic disk's
+// blocks can be allocated without all of its sectors having been written
+func (v *vhd) readSectors(p []byte, off int64) (n int, err error) {
+	block, within, n := span(p, off, v.blockSize)
+	if block >= int64(len(v.bat)) || v.bat[block] == vhdUnallocated {
+		zero(p[:n])
+		return
+	}
+	start := int64(v.bat[block]) * vhdSectorSize
+	if block != v.bitmapIndex {
+		v.bitmap = make([]byte, v.bitmapSize)
+		if err = readFull(v.f, v.bitmap, start); err != nil {
+			return
+		}
+		v.bitmapIndex = block
+	}
+	// read as many sectors as share the first one's state at once
+	sector := within / vhdSectorSize
+	written := v.written(sector)
+	end := sector + 1
+	for end*vhdSectorSize < within+int64(n) && v.written(end) == written {
+		end++
+	}
+	if left := end*vhdSectorSize - within; int64(n) > left {
+		n = int(left)
+	}
+	if !written {
+		zero(p[:n])
+		return
+	}
+	err = readFull(v.f, p[:n], start+v.bitmapSize+within)
+	return
+}
+
+func (v *vhd) written(sector int64) bool {
+	return v.bitmap[sector/8]&(0x80>>uint(sector%8)) != 0
+}
@@ -0,0 +1,341 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package vdisk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	vmdkGDAtEnd      = 0xffffffffffffffff
+	vmdkCompressed   = 1 << 16
+	vmdkZeroGrain    = 1
+	vmdkSectorSize   = 512
+	vmdkMarkerHeader = 12
+)
+
+var (
+	vmdkExtents = regexp.MustCompile(
+		`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"([^"]+)"(?:\s+(\d+))?)?`)
+	vmdkParent = regexp.MustCompile(`(?m)^parentCID\s*=\s*"?([0-9a-fA-F]+)`)
+)
+
+// vmdkSparse is a hosted sparse extent, either monolithic (as VMware and
+// VirtualBox create them) or stream optimized (as in Vagrant boxes and OVAs)
+type vmdkSparse struct {
+	f                   *os.File
+	size, grainSize     int64
+	flags, gtEntries    uint32
+	gd, gt              []uint32
+	gtIndex, grainIndex int64
+	grain               []byte
+}
+
+// vmdkFlat is a plain, raw, extent
+type vmdkFlat struct {
+	f            *os.File
+	offset, size int64
+}
+
+// vmdkZero is an extent with no backing file, all zeroes
+type vmdkZero struct{ size int64 }
+
+// vmdkExtended is a disk made of several extents, as described by a
+// standalone descriptor file
+type vmdkExtended struct{ extents []Disk }
+
+func openVmdkSparse(f *os.File, fileSize int64) (d Disk, err error) {
+	var (
+		header = make([]byte, vmdkSectorSize)
+		v      = &vmdkSparse{f: f, gtIndex: -1, grainIndex: -1}
+		le     = binary.LittleEndian
+	)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return
+	}
+	if desc := int64(le.Uint64(header[28:])); desc != 0 {
+		text := make([]byte, le.Uint64(header[36:])*vmdkSectorSize)
+		if err = readFull(f, text, desc*vmdkSectorSize); err != nil {
+			return
+		}
+		if err = vmdkStandalone(string(text)); err != nil {
+			return
+		}
+	}
+	gdOffset := le.Uint64(header[56:])
+	if gdOffset == vmdkGDAtEnd {
+		// stream optimized, the actual header is at the footer,
+		// followed by the end of stream marker
+		if _, err = f.ReadAt(header, fileSize-2*vmdkSectorSize); err != nil {
+			return
+		}
+		if !bytes.HasPrefix(header, []byte("KDMV")) {
+			return nil, fmt.Errorf("stream optimized vmdk without footer")
+		}
+		gdOffset = le.Uint64(header[56:])
+	}
+	v.flags = le.Uint32(header[8:])
+	v.size = int64(le.Uint64(header[12:])) * vmdkSectorSize
+	v.grainSize = int64(le.Uint64(header[20:])) * vmdkSectorSize
+	v.gtEntries = le.Uint32(header[44:])
+	if v.grainSize == 0 || v.gtEntries == 0 {
+		return nil, fmt.Errorf("vmdk with an invalid grain layout")
+	}
+	if v.flags&vmdkCompressed != 0 && le.Uint16(header[77:]) != 1 {
+		return nil, unsupported("vmdk", "compressed with other than deflate")
+	}
+
+	grains := (v.size + v.grainSize - 1) / v.grainSize
+	tables := (grains + int64(v.gtEntries) - 1) / int64(v.gtEntries)
+	buf := make([]byte, tables*4)
+	if err = readFull(f, buf,
+		int64(gdOffset)*vmdkSectorSize); err != nil {
+		return
+	}
+	for i := int64(0); i < tables; i++ {
+		v.gd = append(v.gd, le.Uint32(buf[i*4:]))
+	}
+	return v, nil
+}
+
+func (v *vmdkSparse) Size() int64    { return v.size }
+func (v *vmdkSparse) Format() string { return "vmdk" }
+func (v *vmdkSparse) Close() error   { return v.f.Close() }
+
+func (v *vmdkSparse) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(p, off, v.size, v.readGrain)
+}
+
+// sector returns where, in the file, the given grain starts
+func (v *vmdkSparse) sector(grain int64) (s uint32, err error) {
+	table := grain / int64(v.gtEntries)
+	if table >= int64(len(v.gd)) || v.gd[table] == 0 {
+		return
+	}
+	if table != v.gtIndex {
+		buf := make([]byte, 4*v.gtEntries)
+		if err = readFull(v.f, buf,
+			int64(v.gd[table])*vmdkSectorSize); err != nil {
+			return
+		}
+		v.gt = make([]uint32, v.gtEntries)
+		for i := range v.gt {
+			v.gt[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		v.gtIndex = table
+	}
+	return v.gt[grain%int64(v.gtEntries)], nil
+}
+
+func (v *vmdkSparse) readGrain(p []byte, off int64) (n int, err error) {
+	var s uint32
+
+	grain, within, n := span(p, off, v.grainSize)
+	if s, err = v.sector(grain); err != nil {
+		return
+	}
+	switch {
+	case s == 0 || s == vmdkZeroGrain:
+		zero(p[:n])
+	case v.flags&vmdkCompressed != 0:
+		if grain != v.grainIndex {
+			if err = v.inflate(int64(s) * vmdkSectorSize); err != nil {
+				return
+			}
+			v.grainIndex = grain
+		}
+		copy(p[:n], v.grain[within:])
+	default:
+		err = readFull(v.f, p[:n], int64(s)*vmdkSectorSize+within)
+	}
+	return
+}
+
+// inflate reads the compressed grain at the given offset, which is
+// preceded by a marker (its LBA and compressed size)
+func (v *vmdkSparse) inflate(offset int64) (err error) {
+	var (
+		z      io.ReadCloser
+		header = make([]byte, vmdkMarkerHeader)
+	)
+	if err = readFull(v.f, header, offset); err != nil {
+		return
+	}
+	compressed := io.NewSectionReader(v.f, offset+vmdkMarkerHeader,
+		int64(binary.LittleEndian.Uint32(header[8:])))
+	if z, err = zlib.NewReader(compressed); err != nil {
+		return
+	}
+	defer z.Close()
+	// the last grain may be shorter than the others
+	v.grain = make([]byte, v.grainSize)
+	if _, err = io.ReadFull(z, v.grain); err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+func (v *vmdkFlat) Size() int64    { return v.size }
+func (v *vmdkFlat) Format() string { return "vmdk" }
+func (v *vmdkFlat) Close() error   { return v.f.Close() }
+
+func (v *vmdkFlat) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(p, off, v.size, func(p []byte, off int64) (int, error) {
+		return len(p), readFull(v.f, p, v.offset+off)
+	})
+}
+
+func (v *vmdkZero) Size() int64    { return v.size }
+func (v *vmdkZero) Format() string { return "vmdk" }
+func (v *vmdkZero) Close() error   { return nil }
+
+func (v *vmdkZero) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(p, off, v.size, func(p []byte, off int64) (int, error) {
+		zero(p)
+		return len(p), nil
+	})
+}
+
+// vmdkStandalone refuses disks that are just the delta of another one
+func vmdkStandalone(descriptor string) error {
+	if m := vmdkParent.FindStringSubmatch(descriptor); m != nil &&
+		strings.ToLower(m[1]) != "ffffffff" {
+		return unsupported("vmdk", "that are snapshots or linked clones")
+	}
+	return nil
+}
+
+func openVmdkDescriptor(path string) (d Disk, err error) {
+	var (
+		f    *os.File
+		text []byte
+		x    = &vmdkExtended{}
+	)
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	if text, err = ioutil.ReadAll(io.LimitReader(f, 64*1024)); err != nil {
+		return
+	}
+	if err = vmdkStandalone(string(text)); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			x.Close()
+		}
+	}()
+	lines := bufio.NewScanner(bytes.NewReader(text))
+	for lines.Scan() {
+		m := vmdkExtents.FindStringSubmatch(strings.TrimSpace(lines.Text()))
+		if m == nil {
+			continue
+		}
+		var (
+			extent  Disk
+			ef      *os.File
+			fi      os.FileInfo
+			size, _ = strconv.ParseInt(m[2], 10, 64)
+			offset  = int64(0)
+			file    = m[4]
+		)
+		size = size * vmdkSectorSize
+		if m[5] != "" {
+			offset, _ = strconv.ParseInt(m[5], 10, 64)
+		}
+		if file != "" && !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		switch m[3] {
+		case "ZERO":
+			extent = &vmdkZero{size}
+		case "FLAT", "VMFS":
+			if ef, err = os.Open(file); err != nil {
+				return
+			}
+			extent = &vmdkFlat{ef, offset * vmdkSectorSize, size}
+		case "SPARSE":
+			if ef, err = os.Open(file); err != nil {
+				return
+			}
+			if fi, err = ef.Stat(); err != nil {
+				ef.Close()
+				return
+			}
+			if extent, err = openVmdkSparse(ef, fi.Size()); err != nil {
+				ef.Close()
+				return
+			}
+			if extent.Size() != size {
+				extent.Close()
+				return nil, fmt.Errorf("%s doesn't match the size "+
+					"that %s expects", file, path)
+			}
+		default:
+			return nil, unsupported("vmdk", "with "+m[3]+" extents")
+		}
+		x.extents = append(x.extents, extent)
+	}
+	if len(x.extents) == 0 {
+		return nil, fmt.Errorf("%s doesn't describe any extent", path)
+	}
+	return x, nil
+}
+
+func (x *vmdkExtended) Format() string { return "vmdk" }
+
+func (x *vmdkExtended) Size() (size int64) {
+	for _, e := range x.extents {
+		size += e.Size()
+	}
+	return
+}
+
+func (x *vmdkExtended) Close() (err error) {
+	for _, e := range x.extents {
+		if ee := e.Close(); ee != nil {
+			err = ee
+		}
+	}
+	return
+}
+
+func (x *vmdkExtended) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(p, off, x.Size(), func(p []byte, off int64) (int, error) {
+		for _, e := range x.extents {
+			if off < e.Size() {
+				if left := e.Size() - off; int64(len(p)) > left {
+					p = p[:left]
+				}
+				return e.ReadAt(p, off)
+			}
+			off -= e.Size()
+		}
+		return 0, io.EOF
+	})
+}
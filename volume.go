@@ -0,0 +1,812 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheNewNormal/corectl/ext4"
+	"github.com/TheNewNormal/corectl/vdisk"
+	"github.com/rakyll/pb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	volumeCmd = &cobra.Command{
+		Use:     "volume",
+		Aliases: []string{"vol"},
+		Short:   "Manages the disk volumes that VMs can use",
+		Long: "Manages raw disk volumes kept by corectl itself.\n" +
+			"Volumes are sparse, so they only take from the host the space " +
+			"that the VM actually writes to, and can be handed to --volume, " +
+			"--root or to profiles by their name instead of by path.",
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			return cmd.Usage()
+		},
+	}
+	volumeCreateCmd = &cobra.Command{
+		Use:     "create NAME",
+		Short:   "Creates a new volume",
+		PreRunE: volumePreRunE(1, 1, false),
+		RunE:    volumeCreateCommand,
+		Example: `  corectl volume create --size 16G var_lib_docker
+  corectl volume create --size 16G --label rkthdd var_lib_docker
+  corectl volume create --from_dir ./fixtures --label fixtures data`,
+	}
+	volumeLsCmd = &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "Lists the existing volumes, and which VMs hold them",
+		PreRunE: defaultPreRunE,
+		RunE:    volumeLsCommand,
+	}
+	volumeRmCmd = &cobra.Command{
+		Use:     "rm NAME[@SNAPSHOT] [NAME[@SNAPSHOT]...]",
+		Short:   "Removes one or more volumes, or just their snapshots",
+		PreRunE: volumePreRunE(1, -1, true),
+		RunE:    volumeRmCommand,
+	}
+	volumeInspectCmd = &cobra.Command{
+		Use:     "inspect NAME",
+		Short:   "Shows the details of a volume",
+		PreRunE: volumePreRunE(1, 1, false),
+		RunE:    volumeInspectCommand,
+	}
+	volumeCloneCmd = &cobra.Command{
+		Use:   "clone SRC[@SNAPSHOT] NEW",
+		Short: "Creates a new volume out of an existing one, or of a snapshot",
+		Long: "Creates a new volume out of an existing one, or of one of " +
+			"its snapshots.\nWhere the host filesystem supports it (APFS) " +
+			"both volumes share their blocks until either one changes them, " +
+			"so cloning is instantaneous regardless of size. Elsewhere a " +
+			"regular, hole preserving, copy is made.",
+		PreRunE: volumePreRunE(2, 2, true),
+		RunE:    volumeCloneCommand,
+		Example: `  corectl volume clone golden dev
+  corectl volume clone golden@pristine dev`,
+	}
+	volumeSnapshotCmd = &cobra.Command{
+		Use:   "snapshot VOLUME NAME",
+		Short: "Takes a point in time snapshot of a volume",
+		Long: "Takes a point in time snapshot of a volume, which must not " +
+			"be in use by any running VM.\nSnapshots are read-only. Passing " +
+			"one, as VOLUME@NAME, to --root or --volume (or to profiles) " +
+			"boots the VM on top of a throwaway clone of it, which gets " +
+			"discarded once the VM halts.",
+		PreRunE: volumePreRunE(2, 2, false),
+		RunE:    volumeSnapshotCommand,
+		Example: `  corectl volume snapshot golden pristine
+  corectl run --root golden@pristine`,
+	}
+	volumeResizeCmd = &cobra.Command{
+		Use:   "resize NAME SIZE",
+		Short: "Grows a volume",
+		Long: "Grows a volume, which must not be in use by any running VM, " +
+			"either to the given SIZE or, if prefixed with '+', by it.\n" +
+			"The added space is sparse and, with --grow_fs, the ext4 or " +
+			"btrfs filesystem within gets grown too, the next time that " +
+			"the volume is booted.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if len(args) != 2 {
+				return fmt.Errorf("Incorrect usage: " +
+					"see 'corectl volume " + cmd.Use + "'")
+			}
+			return volumePreRunE(1, 1, false)(cmd, args[:1])
+		},
+		RunE: volumeResizeCommand,
+		Example: `  corectl volume resize var_lib_docker 32G
+  corectl volume resize --grow_fs var_lib_docker +16G`,
+	}
+	volumeImportCmd = &cobra.Command{
+		Use:   "import PATH",
+		Short: "Creates a new volume out of another hypervisor's disk image",
+		Long: "Creates a new volume out of a disk image from another " +
+			"hypervisor, converting it to the raw sparse format that " +
+			"corectl's VMs use.\nqcow2 (QEMU), vmdk (VMware, VirtualBox, " +
+			"Vagrant boxes) and vhd (Hyper-V, Virtual PC) images are " +
+			"supported, as long as they stand on their own (i.e. aren't " +
+			"snapshots, linked clones or differencing disks) and aren't " +
+			"encrypted. By default the volume is named after the image file.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if len(args) != 1 {
+				return fmt.Errorf("Incorrect usage: " +
+					"see 'corectl volume " + cmd.Use + "'")
+			}
+			engine.rawArgs.BindPFlags(cmd.Flags())
+			return
+		},
+		RunE: volumeImportCommand,
+		Example: `  corectl volume import ~/Downloads/coreos_production_qemu_image.qcow2
+  corectl volume import --name golden box-disk1.vmdk`,
+	}
+	volumeNames = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+func volumePreRunE(min, max int,
+	snapshots bool) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) < min || (max > 0 && len(args) > max) {
+			return fmt.Errorf("Incorrect usage: " +
+				"see 'corectl volume " + cmd.Use + "'")
+		}
+		for _, name := range args {
+			if _, _, ok := snapshotRef(name); ok && snapshots {
+				continue
+			}
+			if !isVolumeName(name) {
+				return fmt.Errorf("Aborting: '%s' isn't a valid volume "+
+					"name (letters, digits, '.', '_' and '-' only, "+
+					"not ending in '.img')", name)
+			}
+		}
+		engine.rawArgs.BindPFlags(cmd.Flags())
+		return
+	}
+}
+
+// isVolumeName tells apart references to managed volumes from paths to
+// plain image files
+func isVolumeName(ref string) bool {
+	return volumeNames.MatchString(ref) && !strings.HasSuffix(ref, ".img")
+}
+
+// snapshotRef splits references to snapshots, as in VOLUME@SNAPSHOT
+func snapshotRef(ref string) (volume, snapshot string, ok bool) {
+	if parts := strings.SplitN(ref, "@", 2); len(parts) == 2 &&
+		isVolumeName(parts[0]) && isVolumeName(parts[1]) {
+		return parts[0], parts[1], true
+	}
+	return
+}
+
+func snapshotPath(volume, snapshot string) string {
+	return filepath.Join(engine.volumeDir, volume, "snapshots",
+		snapshot+".img")
+}
+
+// diskSource maps a volume reference into the image that backs it, which
+// for snapshots is the snapshot itself and not the VM's throwaway clone
+func diskSource(ref string) (string, error) {
+	if volume, snapshot, ok := snapshotRef(ref); ok {
+		return snapshotPath(volume, snapshot), nil
+	}
+	return volumePath(ref)
+}
+
+// volumePath maps a volume reference, either a path to a raw image or the
+// name of a managed volume, into an absolute path
+func volumePath(ref string) (string, error) {
+	if isVolumeName(ref) {
+		return filepath.Join(engine.volumeDir, ref, "disk.img"), nil
+	}
+	return filepath.Abs(ref)
+}
+
+// parseSize reads sizes such as 512M, 16G or 1T (powers of 1024) into bytes
+func parseSize(size string) (bytes int64, err error) {
+	var (
+		unit  int64 = 1
+		units       = map[string]int64{"K": 1 << 10, "M": 1 << 20,
+			"G": 1 << 30, "T": 1 << 40}
+		s = strings.TrimSuffix(strings.TrimSuffix(
+			strings.ToUpper(strings.TrimSpace(size)), "B"), "I")
+	)
+	if len(s) > 0 {
+		if u, ok := units[s[len(s)-1:]]; ok {
+			unit, s = u, s[:len(s)-1]
+		}
+	}
+	if bytes, err = strconv.ParseInt(s, 10, 64); err != nil || bytes < 1 {
+		return 0, fmt.Errorf("Aborting: '%s' isn't a valid size "+
+			"(try something like 512M or 16G)", size)
+	}
+	return bytes * unit, nil
+}
+
+func humanSize(bytes int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value, i := float64(bytes), 0
+	for ; value >= 1024 && i < len(units)-1; i++ {
+		value = value / 1024
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", value), ".0") + units[i]
+}
+
+// volumeHolders maps the disk images in use by running VMs to their names
+func volumeHolders() (held map[string]string, err error) {
+	var up []VMInfo
+
+	held = make(map[string]string)
+	if up, err = allRunningInstances(); err != nil {
+		return
+	}
+	for _, vm := range up {
+		for _, d := range vm.Storage.HardDrives {
+			held[d.Path] = vm.Name
+		}
+	}
+	return
+}
+
+func readVolume(name string) (vol VolumeInfo, err error) {
+	var (
+		buf  []byte
+		fi   os.FileInfo
+		dir  = filepath.Join(engine.volumeDir, name)
+		path = filepath.Join(dir, "disk.img")
+	)
+	if buf, err = ioutil.ReadFile(filepath.Join(dir, "config")); err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("no volume named '%s' (see 'corectl "+
+				"volume ls')", name)
+		}
+		return
+	}
+	if err = json.Unmarshal(buf, &vol); err != nil {
+		return
+	}
+	if fi, err = os.Stat(path); err != nil {
+		return
+	}
+	vol.Path, vol.Size = path, fi.Size()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		vol.Allocated = st.Blocks * 512
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "snapshots", "*.img"))
+	for _, s := range snapshots {
+		vol.Snapshots = append(vol.Snapshots,
+			strings.TrimSuffix(filepath.Base(s), ".img"))
+	}
+	return
+}
+
+// cloneFile copies src into dst. where the filesystem supports it (APFS)
+// both files end up sharing their blocks, via clonefile(2), otherwise a
+// copy which preserves src's holes is made
+func cloneFile(src, dst string) (err error) {
+	if err = exec.Command("cp", "-c", src, dst).Run(); err == nil {
+		return
+	}
+	os.Remove(dst)
+	return sparseCopy(src, dst)
+}
+
+func sparseCopy(src, dst string) (err error) {
+	var (
+		in *os.File
+		fi os.FileInfo
+	)
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if fi, err = in.Stat(); err != nil {
+		return
+	}
+	return sparseWrite(in, fi.Size(), dst)
+}
+
+// sparseWrite streams in into a new dst file, of the given size, leaving as
+// holes whatever reads as all zeroes
+func sparseWrite(in io.Reader, size int64, dst string) (err error) {
+	var (
+		out    *os.File
+		n      int
+		block  = make([]byte, 64*1024)
+		zeroes = make([]byte, len(block))
+	)
+	if out, err = os.OpenFile(dst,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		return
+	}
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	for {
+		if n, err = io.ReadFull(in, block); n > 0 {
+			// all zeroes blocks are skipped, and so left as holes
+			if bytes.Equal(block[:n], zeroes[:n]) {
+				_, err = out.Seek(int64(n), os.SEEK_CUR)
+			} else {
+				_, err = out.Write(block[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return
+		}
+	}
+	return out.Truncate(size)
+}
+
+// store saves the volume's settings alongside its disk image. what gets
+// derived from the disk image itself, on every read, isn't kept
+func (vol *VolumeInfo) store() (err error) {
+	var (
+		buf    []byte
+		dir    = filepath.Join(engine.volumeDir, vol.Name)
+		stored = *vol
+	)
+	stored.Path, stored.Size, stored.Allocated = "", 0, 0
+	stored.Snapshots, stored.HeldBy = nil, ""
+	if buf, err = json.MarshalIndent(stored, "", "    "); err != nil {
+		return
+	}
+	if err = writeFileAtomic(filepath.Join(dir, "config"),
+		buf, 0644); err != nil {
+		return
+	}
+	return normalizeOnDiskPermissions(dir)
+}
+
+func volumeCreateCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		size   int64
+		img    *os.File
+		name   = args[0]
+		label  = engine.rawArgs.GetString("label")
+		source = engine.rawArgs.GetString("from_dir")
+		fs     = engine.rawArgs.GetString("fs")
+		dir    = filepath.Join(engine.volumeDir, name)
+		vol    = VolumeInfo{Name: name, Label: label, CreatedAt: time.Now()}
+	)
+
+	if fs == "" && (label != "" || source != "") {
+		fs = "ext4"
+	}
+	if fs != "" && fs != "ext4" {
+		return fmt.Errorf("Aborting: '%s' isn't a supported filesystem "+
+			"(only ext4 is)", fs)
+	}
+	if s := engine.rawArgs.GetString("size"); s != "" {
+		if size, err = parseSize(s); err != nil {
+			return
+		}
+	} else if source == "" {
+		size = 16 << 30
+	}
+	if len(label) > 16 {
+		return fmt.Errorf("Aborting: '%s' is too long for an ext4 label "+
+			"(16 characters at most)", label)
+	}
+	if source != "" {
+		if fi, e := os.Stat(source); e != nil || !fi.IsDir() {
+			return fmt.Errorf("Aborting: '%s' isn't a directory", source)
+		}
+	}
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("Aborting: a volume named '%s' already exists",
+			name)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	vol.Path = filepath.Join(dir, "disk.img")
+	if fs != "" {
+		if size, err = ext4.Build(vol.Path, source,
+			ext4.Options{Label: label, Size: size}); err != nil {
+			return fmt.Errorf("Aborting: unable to build %s (%v)",
+				vol.Path, err)
+		}
+	} else {
+		if img, err = os.Create(vol.Path); err != nil {
+			return
+		}
+		// sparse, so it only grows as the VM writes to it
+		err = img.Truncate(size)
+		img.Close()
+		if err != nil {
+			return
+		}
+	}
+	if err = vol.store(); err != nil {
+		return
+	}
+	log.Printf("created volume '%s' (%s)\n", name, humanSize(size))
+	return
+}
+
+func volumeLsCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		ls   []os.FileInfo
+		vols []VolumeInfo
+		held map[string]string
+		pp   []byte
+	)
+	if ls, err = ioutil.ReadDir(engine.volumeDir); err != nil {
+		return
+	}
+	if held, err = volumeHolders(); err != nil {
+		return
+	}
+	for _, d := range ls {
+		vol, e := readVolume(d.Name())
+		if e != nil {
+			log.Printf("skipping '%s': %v\n", d.Name(), e)
+			continue
+		}
+		vol.HeldBy = held[vol.Path]
+		vols = append(vols, vol)
+	}
+	if engine.rawArgs.GetBool("json") {
+		if pp, err = json.MarshalIndent(vols, "", "    "); err == nil {
+			fmt.Println(string(pp))
+		}
+		return
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 5, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "name\tsize\tallocated\tlabel\tsnapshots\theld by\n")
+	for _, vol := range vols {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", vol.Name,
+			humanSize(vol.Size), humanSize(vol.Allocated), vol.Label,
+			strings.Join(vol.Snapshots, ","), vol.HeldBy)
+	}
+	w.Flush()
+	return
+}
+
+func volumeRmCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		lock *os.File
+		held map[string]string
+		vol  VolumeInfo
+	)
+	// so that no VM gets to claim the volumes while they're being removed
+	if lock, err = lockRunning(); err != nil {
+		return
+	}
+	defer lock.Close()
+	if held, err = volumeHolders(); err != nil {
+		return
+	}
+	for _, name := range args {
+		if volume, snapshot, ok := snapshotRef(name); ok {
+			// running VMs only hold clones of snapshots, never these
+			if err = os.Remove(snapshotPath(volume,
+				snapshot)); os.IsNotExist(err) {
+				return fmt.Errorf("no snapshot named '%s'", name)
+			} else if err != nil {
+				return
+			}
+			log.Printf("removed snapshot '%s'\n", name)
+			continue
+		}
+		if vol, err = readVolume(name); err != nil {
+			return
+		}
+		if vm, busy := held[vol.Path]; busy {
+			return fmt.Errorf("Aborting: volume '%s' is being used by '%s'",
+				name, vm)
+		}
+		if err = os.RemoveAll(filepath.Dir(vol.Path)); err != nil {
+			return
+		}
+		log.Printf("removed volume '%s'\n", name)
+	}
+	return
+}
+
+func volumeInspectCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		held map[string]string
+		vol  VolumeInfo
+		pp   []byte
+	)
+	if vol, err = readVolume(args[0]); err != nil {
+		return
+	}
+	if held, err = volumeHolders(); err != nil {
+		return
+	}
+	vol.HeldBy = held[vol.Path]
+	if pp, err = json.MarshalIndent(vol, "", "    "); err == nil {
+		fmt.Println(string(pp))
+	}
+	return
+}
+
+func volumeCloneCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		lock       *os.File
+		vol        VolumeInfo
+		held       map[string]string
+		src, clone = args[0], args[1]
+		dir        = filepath.Join(engine.volumeDir, clone)
+	)
+
+	if !isVolumeName(clone) {
+		return fmt.Errorf("Aborting: '%s' isn't a valid volume name", clone)
+	}
+	if volume, snapshot, ok := snapshotRef(src); ok {
+		if vol, err = readVolume(volume); err != nil {
+			return
+		}
+		vol.Path = snapshotPath(volume, snapshot)
+		if _, err = os.Stat(vol.Path); err != nil {
+			return fmt.Errorf("no snapshot named '%s'", src)
+		}
+	} else {
+		if vol, err = readVolume(src); err != nil {
+			return
+		}
+		// held until cloned, so that no VM gets to claim it meanwhile
+		if lock, err = lockRunning(); err != nil {
+			return
+		}
+		defer lock.Close()
+		if held, err = volumeHolders(); err != nil {
+			return
+		}
+		if vm, busy := held[vol.Path]; busy {
+			return fmt.Errorf("Aborting: volume '%s' is being used by "+
+				"'%s', so it can't be cloned consistently", src, vm)
+		}
+	}
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("Aborting: a volume named '%s' already exists",
+			clone)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err = cloneFile(vol.Path, filepath.Join(dir, "disk.img")); err != nil {
+		return
+	}
+	vol = VolumeInfo{Name: clone, Label: vol.Label, Origin: src,
+		CreatedAt: time.Now()}
+	if err = vol.store(); err != nil {
+		return
+	}
+	log.Printf("created volume '%s' as a clone of '%s'\n", clone, src)
+	return
+}
+
+func volumeSnapshotCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		lock             *os.File
+		vol              VolumeInfo
+		held             map[string]string
+		volume, snapshot = args[0], args[1]
+		target           = snapshotPath(volume, snapshot)
+	)
+
+	if vol, err = readVolume(volume); err != nil {
+		return
+	}
+	// held until snapshotted, so that no VM gets to claim it meanwhile
+	if lock, err = lockRunning(); err != nil {
+		return
+	}
+	defer lock.Close()
+	if held, err = volumeHolders(); err != nil {
+		return
+	}
+	if vm, busy := held[vol.Path]; busy {
+		return fmt.Errorf("Aborting: volume '%s' is being used by '%s', "+
+			"so it can't be snapshotted consistently", volume, vm)
+	}
+	if _, err = os.Stat(target); err == nil {
+		return fmt.Errorf("Aborting: '%s@%s' already exists",
+			volume, snapshot)
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return
+	}
+	if err = cloneFile(vol.Path, target); err != nil {
+		return
+	}
+	// snapshots are immutable
+	if err = os.Chmod(target, 0444); err != nil {
+		return
+	}
+	if err = normalizeOnDiskPermissions(filepath.Dir(target)); err != nil {
+		return
+	}
+	log.Printf("created snapshot '%s@%s'\n", volume, snapshot)
+	return
+}
+
+func volumeResizeCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		size int64
+		lock *os.File
+		vol  VolumeInfo
+		held map[string]string
+		name = args[0]
+	)
+
+	// held until resized, so that no VM (nor other resize) gets to the
+	// volume meanwhile
+	if lock, err = lockRunning(); err != nil {
+		return
+	}
+	defer lock.Close()
+	if vol, err = readVolume(name); err != nil {
+		return
+	}
+	if size, err = parseSize(strings.TrimPrefix(args[1], "+")); err != nil {
+		return
+	}
+	if strings.HasPrefix(args[1], "+") {
+		size = size + vol.Size
+	}
+	if size < vol.Size {
+		return fmt.Errorf("Aborting: volumes can only grow ('%s' already "+
+			"has %s)", name, humanSize(vol.Size))
+	}
+	if held, err = volumeHolders(); err != nil {
+		return
+	}
+	if vm, busy := held[vol.Path]; busy {
+		return fmt.Errorf("Aborting: volume '%s' is being used by '%s'",
+			name, vm)
+	}
+	if size > vol.Size {
+		// sparse, as on creation
+		if err = os.Truncate(vol.Path, size); err != nil {
+			return
+		}
+		log.Printf("resized volume '%s' from %s to %s\n", name,
+			humanSize(vol.Size), humanSize(size))
+	}
+	if engine.rawArgs.GetBool("grow_fs") {
+		vol.GrowFS = true
+		log.Printf("the filesystem within '%s' will be grown on next boot\n",
+			name)
+	}
+	return vol.store()
+}
+
+func volumeImportCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		source string
+		disk   vdisk.Disk
+		name   = engine.rawArgs.GetString("name")
+	)
+
+	if source, err = filepath.Abs(args[0]); err != nil {
+		return
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(source),
+			filepath.Ext(source))
+	}
+	if !isVolumeName(name) {
+		return fmt.Errorf("Aborting: '%s' isn't a valid volume name "+
+			"(pick another one with --name)", name)
+	}
+	dir := filepath.Join(engine.volumeDir, name)
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("Aborting: a volume named '%s' already exists",
+			name)
+	}
+	if disk, err = vdisk.Open(source); err != nil {
+		return fmt.Errorf("Aborting: %v", err)
+	}
+	defer disk.Close()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	vol := VolumeInfo{Name: name, Path: filepath.Join(dir, "disk.img"),
+		Origin: source, CreatedAt: time.Now()}
+	log.Printf("importing '%s' (%s, %s) as volume '%s'\n", source,
+		disk.Format(), humanSize(disk.Size()), name)
+	bar := pb.New(int(disk.Size())).SetUnits(pb.U_BYTES)
+	bar.Start()
+	err = sparseWrite(io.TeeReader(io.NewSectionReader(disk, 0,
+		disk.Size()), bar), disk.Size(), vol.Path)
+	bar.Finish()
+	if err != nil {
+		return fmt.Errorf("Aborting: unable to convert '%s' (%v)",
+			source, err)
+	}
+	if err = vol.store(); err != nil {
+		return
+	}
+	log.Printf("created volume '%s' (%s)\n", name, humanSize(disk.Size()))
+	return
+}
+
+// volumesToGrow returns the devices, as seen from within the VM, whose
+// filesystems were flagged to be grown, clearing the flags if asked to
+func (vm *VMInfo) volumesToGrow(clear bool) (devices []string) {
+	for slot, d := range vm.Storage.HardDrives {
+		if d.Snapshot != "" ||
+			filepath.Dir(filepath.Dir(d.Path)) != engine.volumeDir {
+			continue
+		}
+		vol, err := readVolume(filepath.Base(filepath.Dir(d.Path)))
+		if err != nil || !vol.GrowFS {
+			continue
+		}
+		i, _ := strconv.Atoi(slot)
+		devices = append(devices, fmt.Sprintf("/dev/vd%c", 'a'+i))
+		if !clear {
+			continue
+		}
+		vol.GrowFS = false
+		if err = vol.store(); err != nil {
+			log.Println(err)
+		}
+	}
+	return
+}
+
+func init() {
+	volumeCreateCmd.Flags().StringP("size", "s", "",
+		"volume size, such as 512M or 16G (defaults to 16G or, with "+
+			"--from_dir, to what its contents need)")
+	volumeCreateCmd.Flags().StringP("label", "l", "",
+		"formats the volume as ext4, with the given label, so that "+
+			"cloud-configs can find it under /dev/disk/by-label/")
+	volumeCreateCmd.Flags().String("fs", "",
+		"formats the volume with the given filesystem (ext4)")
+	volumeCreateCmd.Flags().String("from_dir", "",
+		"populates the volume's filesystem with a copy of the given "+
+			"host directory")
+	volumeResizeCmd.Flags().Bool("grow_fs", false,
+		"grows the volume's ext4 or btrfs filesystem on next boot")
+	volumeImportCmd.Flags().StringP("name", "n", "",
+		"names the new volume (defaults to the image's file name, "+
+			"without its extension)")
+	volumeLsCmd.Flags().BoolP("json", "j", false,
+		"outputs in JSON for easy 3rd party integration")
+	volumeCmd.AddCommand(volumeCreateCmd, volumeLsCmd, volumeRmCmd,
+		volumeInspectCmd, volumeCloneCmd, volumeSnapshotCmd, volumeResizeCmd,
+		volumeImportCmd)
+	RootCmd.AddCommand(volumeCmd)
+}
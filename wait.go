@@ -0,0 +1,142 @@
+// Copyright 2015 - António Meireles  <antonio.meireles@reformi.st>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// exit statuses of 'corectl wait', besides 0 when the condition holds and the
+// usual one for any other failure
+const (
+	waitTimedOut = 1
+	waitHalted   = 2
+)
+
+var (
+	waitCmd = &cobra.Command{
+		Use:   "wait VMid",
+		Short: "Waits for a CoreOS instance to reach a given state",
+		Long: "Waits for a CoreOS instance to reach a given state, " +
+			"which is either being running, having an IP, being halted " +
+			"or any of the conditions that 'run --wait_for' takes (ssh, " +
+			"tcp:PORT, unit:NAME or http:[PORT]/PATH).\n" +
+			"A VM that isn't running yet is waited for too, except when " +
+			"waiting for it to be\nhalted, as then any VM that isn't " +
+			"running (even an unknown one) counts as halted.\n" +
+			"Exits with 0 once the state is reached, " +
+			fmt.Sprintf("%v if it timed out, %v if the VM halted before "+
+				"reaching it", waitTimedOut, waitHalted) +
+			", and 255 on any other failure.",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			engine.rawArgs.BindPFlags(cmd.Flags())
+			if len(args) != 1 {
+				return fmt.Errorf("Incorrect usage. " +
+					"This command requires exactly one argument (a VM's " +
+					"name or UUID).")
+			}
+			return
+		},
+		RunE: waitCommand,
+		Example: `  corectl wait --for ip VMid
+  corectl wait --for unit:docker.service --timeout 2m VMid
+  corectl halt VMid && corectl wait --for halted VMid`,
+	}
+)
+
+func waitCommand(cmd *cobra.Command, args []string) (err error) {
+	var (
+		vm       VMInfo
+		checks   []readyCheck
+		seen     bool
+		id, cond = args[0], engine.rawArgs.GetString("for")
+		timeout  = engine.rawArgs.GetDuration("timeout")
+		deadline = time.Now().Add(timeout)
+	)
+
+	switch cond {
+	case "running", "ip", "halted":
+	default:
+		if checks, err = parseReadyChecks([]string{cond}); err != nil ||
+			len(checks) == 0 {
+			return fmt.Errorf("Aborting: '%s' isn't a state to wait for "+
+				"(running, ip, halted, ssh, tcp:PORT, unit:NAME or "+
+				"http:[PORT]/PATH)", cond)
+		}
+	}
+	// from now on, failures are about the VM and not about how we got called
+	cmd.SilenceUsage = true
+
+	for {
+		var (
+			up     []VMInfo
+			broken map[string]error
+			found  bool
+		)
+		// only the VM not being around (anymore) tells that it halted, as
+		// any other failure means that nothing got actually checked
+		if up, broken, err = runningInstances(); err != nil {
+			return
+		}
+		if e, ok := broken[id]; ok {
+			return fmt.Errorf("unable to tell the state of '%s' (%v)", id, e)
+		}
+		for _, v := range up {
+			if v.Name == id || v.UUID == id {
+				vm, found = v, true
+				break
+			}
+		}
+		switch {
+		case cond == "halted":
+			if !found {
+				return nil
+			}
+		case !found:
+			if seen {
+				return exitError{fmt.Errorf("'%s' halted before reaching "+
+					"'%s'", id, cond), waitHalted}
+			}
+		case cond == "running":
+			return nil
+		case vm.PublicIP == "":
+			// still booting
+			seen = true
+		case cond == "ip":
+			return nil
+		default:
+			seen = true
+			if checks[0].check(&vm) == nil {
+				return nil
+			}
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return exitError{fmt.Errorf("timed out, after %v, waiting for "+
+				"'%s' to reach '%s'", timeout, id, cond), waitTimedOut}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func init() {
+	waitCmd.Flags().String("for", "running", "the state to wait for")
+	waitCmd.Flags().Duration("timeout", 5*time.Minute,
+		"how long to wait, at most (0 for as long as it takes)")
+	RootCmd.AddCommand(waitCmd)
+}